@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/golang/protobuf/proto"
@@ -24,18 +25,25 @@ func main() {
 	}
 	defer client.Close()
 
+	if err := client.SetFraming(rpc.FramingVarint); err != nil {
+		log.Fatal("negotiate framing:", err)
+	}
+
 	// register callbacks
 	if err := client.RegisterModule(new(Test)); err != nil {
 		log.Fatal("register error:", err)
 	}
+	// handle strobes in arrival order
+	if err := client.SetSerial("test.strobe"); err != nil {
+		log.Fatal("set serial error:", err)
+	}
 
 	go client.Serve()
 	// echo
-	req := &proto_test.Echo{Req: proto.String("hello")}
-	echod := proto_test.Echo_Response{}
-	callErr := client.MustCall("test.echo", req, &echod)
-	if callErr != nil {
-		log.Fatal("call test.echo:", callErr)
+	test := descriptor.NewTestClient(client)
+	echod, err := test.Echo(context.Background(), &proto_test.Echo{Req: proto.String("hello")})
+	if err != nil {
+		log.Fatal("call test.echo:", err)
 	}
 	log.Printf("echo response:%s", echod.GetResp())
 }
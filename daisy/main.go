@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -20,21 +25,33 @@ func (t *Test) Echo(context *rpc.Context, req *proto_test.Echo, rsp *proto_test.
 	return nil
 }
 
-func register(server *rpc.Server, rcvr interface{}) {
-	err := server.RegisterModule(rcvr)
-	if err != nil {
-		log.Fatal("register error:", err)
-	}
-}
-
 func main() {
 	bridge := rpc.NewBridge(descriptor.Descriptors)
 	server := bridge.NewServer()
-	register(server, new(Debug))
-	register(server, new(Test))
+	if err := descriptor.RegisterDebugServer(server, new(Debug)); err != nil {
+		log.Fatal("register error:", err)
+	}
+	// strobe is served by clients, Test is not a complete TestServer
+	if err := server.RegisterModule(new(Test)); err != nil {
+		log.Fatal("register error:", err)
+	}
 	l, err := net.Listen("tcp", ":1234")
 	if err != nil {
 		log.Fatal("listen error:", err)
 	}
-	server.Accept(l)
+	go func() {
+		if err := server.Accept(l); err != rpc.ErrServerClosed {
+			log.Fatal("accept error:", err)
+		}
+	}()
+
+	// drain connections on SIGINT or SIGTERM
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
 }
@@ -4,6 +4,7 @@
 package descriptor
 
 import (
+	"context"
 	"reflect"
 
 	"github.com/xjdrew/daisy/pb/rpc"
@@ -19,6 +20,9 @@ var Descriptors = []rpc.Descriptor{
 		MethodName: "Debug.Ping",
 		ArgType:    reflect.TypeOf(&proto_debug.Ping{}),
 		ReplyType:  reflect.TypeOf(&proto_debug.Ping_Response{}),
+		Public:     true,
+		NewArgs:    newDebugPingArgs,
+		Handler:    handleDebugPing,
 	},
 
 	{
@@ -27,6 +31,8 @@ var Descriptors = []rpc.Descriptor{
 		MethodName: "Test.Echo",
 		ArgType:    reflect.TypeOf(&proto_test.Echo{}),
 		ReplyType:  reflect.TypeOf(&proto_test.Echo_Response{}),
+		NewArgs:    newTestEchoArgs,
+		Handler:    handleTestEcho,
 	},
 
 	{
@@ -35,5 +41,103 @@ var Descriptors = []rpc.Descriptor{
 		MethodName: "Test.Strobe",
 		ArgType:    reflect.TypeOf(&proto_test.Strobe{}),
 		ReplyType:  nil,
+		NewArgs:    newTestStrobeArgs,
+		Handler:    handleTestStrobe,
 	},
 }
+
+func newDebugPingArgs() (argv, reply interface{}) {
+	return new(proto_debug.Ping), new(proto_debug.Ping_Response)
+}
+
+func handleDebugPing(rcvr interface{}, c *rpc.Context, argv, reply interface{}) *rpc.CallError {
+	return rcvr.(interface {
+		Ping(*rpc.Context, *proto_debug.Ping, *proto_debug.Ping_Response) *rpc.CallError
+	}).Ping(c, argv.(*proto_debug.Ping), reply.(*proto_debug.Ping_Response))
+}
+
+func newTestEchoArgs() (argv, reply interface{}) {
+	return new(proto_test.Echo), new(proto_test.Echo_Response)
+}
+
+func handleTestEcho(rcvr interface{}, c *rpc.Context, argv, reply interface{}) *rpc.CallError {
+	return rcvr.(interface {
+		Echo(*rpc.Context, *proto_test.Echo, *proto_test.Echo_Response) *rpc.CallError
+	}).Echo(c, argv.(*proto_test.Echo), reply.(*proto_test.Echo_Response))
+}
+
+func newTestStrobeArgs() (argv, reply interface{}) {
+	return new(proto_test.Strobe), nil
+}
+
+func handleTestStrobe(rcvr interface{}, c *rpc.Context, argv, reply interface{}) *rpc.CallError {
+	rcvr.(interface {
+		Strobe(*rpc.Context, *proto_test.Strobe)
+	}).Strobe(c, argv.(*proto_test.Strobe))
+	return nil
+}
+
+// typed client of module debug
+type DebugClient struct {
+	caller rpc.Caller
+}
+
+func NewDebugClient(caller rpc.Caller) *DebugClient {
+	return &DebugClient{caller: caller}
+}
+
+func (c *DebugClient) Ping(ctx context.Context, argv *proto_debug.Ping) (*proto_debug.Ping_Response, error) {
+	reply := new(proto_debug.Ping_Response)
+	callError, err := c.caller.CallContext(ctx, "debug.ping", argv, reply)
+	if err != nil {
+		return nil, err
+	}
+	if callError != nil {
+		return nil, callError
+	}
+	return reply, nil
+}
+
+// typed client of module test
+type TestClient struct {
+	caller rpc.Caller
+}
+
+func NewTestClient(caller rpc.Caller) *TestClient {
+	return &TestClient{caller: caller}
+}
+
+func (c *TestClient) Echo(ctx context.Context, argv *proto_test.Echo) (*proto_test.Echo_Response, error) {
+	reply := new(proto_test.Echo_Response)
+	callError, err := c.caller.CallContext(ctx, "test.echo", argv, reply)
+	if err != nil {
+		return nil, err
+	}
+	if callError != nil {
+		return nil, callError
+	}
+	return reply, nil
+}
+
+func (c *TestClient) Strobe(ctx context.Context, argv *proto_test.Strobe) error {
+	return c.caller.InvokeContext(ctx, "test.strobe", argv)
+}
+
+// services of module debug, implementation can have any type name
+type DebugServer interface {
+	Ping(c *rpc.Context, argv *proto_debug.Ping, reply *proto_debug.Ping_Response) *rpc.CallError
+}
+
+func RegisterDebugServer(r rpc.ServiceRegistrar, impl DebugServer) error {
+	return r.RegisterService("Debug", reflect.TypeOf((*DebugServer)(nil)).Elem(), impl)
+}
+
+// services of module test, implementation can have any type name
+type TestServer interface {
+	Echo(c *rpc.Context, argv *proto_test.Echo, reply *proto_test.Echo_Response) *rpc.CallError
+	Strobe(c *rpc.Context, argv *proto_test.Strobe)
+}
+
+func RegisterTestServer(r rpc.ServiceRegistrar, impl TestServer) error {
+	return r.RegisterService("Test", reflect.TypeOf((*TestServer)(nil)).Elem(), impl)
+}
@@ -0,0 +1,105 @@
+package descriptor
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/test"
+	"github.com/xjdrew/daisy/pb/rpc"
+)
+
+type testServer struct {
+	strobe chan string
+}
+
+// fails on "fail"
+func (s *testServer) Echo(c *rpc.Context, argv *proto_test.Echo, reply *proto_test.Echo_Response) *rpc.CallError {
+	if argv.GetReq() == "fail" {
+		return rpc.NewCallError(7, "echo failed")
+	}
+	reply.Resp = argv.Req
+	return nil
+}
+
+func (s *testServer) Strobe(c *rpc.Context, argv *proto_test.Strobe) {
+	s.strobe <- argv.GetMsg()
+}
+
+func listenTestServer(t *testing.T) (*rpc.Server, *testServer, string) {
+	server := rpc.NewBridge(Descriptors).NewServer()
+	impl := &testServer{strobe: make(chan string, 16)}
+	if err := RegisterTestServer(server, impl); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	return server, impl, l.Addr().String()
+}
+
+// typed client works the same through every Caller
+func testClient(t *testing.T, client *TestClient, impl *testServer) {
+	ctx := context.Background()
+	rsp, err := client.Echo(ctx, &proto_test.Echo{Req: proto.String("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.GetResp() != "hello" {
+		t.Fatalf("unexpected reply: %s", rsp.GetResp())
+	}
+
+	// CallError is returned as error
+	rsp, err = client.Echo(ctx, &proto_test.Echo{Req: proto.String("fail")})
+	if rsp != nil {
+		t.Fatalf("failed call has reply %v", rsp)
+	}
+	callError, ok := err.(*rpc.CallError)
+	if !ok || callError.Code != 7 {
+		t.Fatalf("expect CallError 7, got %v", err)
+	}
+
+	if err := client.Strobe(ctx, &proto_test.Strobe{Msg: proto.String("strobe")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-impl.strobe; msg != "strobe" {
+		t.Fatalf("unexpected strobe: %s", msg)
+	}
+}
+
+func TestContextClient(t *testing.T) {
+	server, impl, addr := listenTestServer(t)
+	defer server.Close()
+
+	client, err := rpc.NewBridge(Descriptors).Dail("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	defer client.Close()
+
+	testClient(t, NewTestClient(client.Context), impl)
+}
+
+func TestPoolClient(t *testing.T) {
+	server, impl, addr := listenTestServer(t)
+	defer server.Close()
+
+	pool := rpc.NewBridge(Descriptors).NewPool("tcp", []string{addr})
+	pool.Start()
+	defer pool.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !pool.Backends()[0].Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("backend is not healthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	testClient(t, NewTestClient(pool), impl)
+}
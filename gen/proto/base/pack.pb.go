@@ -10,6 +10,7 @@ It is generated from these files:
 
 It has these top-level messages:
 	Error
+	Header
 	Pack
 */
 package proto_base
@@ -53,12 +54,39 @@ func (m *Error) GetError() string {
 	return ""
 }
 
+type Header struct {
+	Key              *string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Header) Reset()         { *m = Header{} }
+func (m *Header) String() string { return proto.CompactTextString(m) }
+func (*Header) ProtoMessage()    {}
+
+func (m *Header) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *Header) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
 type Pack struct {
-	Session          *int32 `protobuf:"varint,1,opt,name=session" json:"session,omitempty"`
-	Type             *int32 `protobuf:"varint,2,opt,name=type" json:"type,omitempty"`
-	Error            *Error `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
-	Data             []byte `protobuf:"bytes,4,opt,name=data" json:"data,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	Session          *int32    `protobuf:"varint,1,opt,name=session" json:"session,omitempty"`
+	Type             *int32    `protobuf:"varint,2,opt,name=type" json:"type,omitempty"`
+	Error            *Error    `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+	Data             []byte    `protobuf:"bytes,4,opt,name=data" json:"data,omitempty"`
+	More             *bool     `protobuf:"varint,5,opt,name=more" json:"more,omitempty"`
+	Timeout          *int32    `protobuf:"varint,6,opt,name=timeout" json:"timeout,omitempty"`
+	Meta             []*Header `protobuf:"bytes,7,rep,name=meta" json:"meta,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
 }
 
 func (m *Pack) Reset()         { *m = Pack{} }
@@ -93,5 +121,26 @@ func (m *Pack) GetData() []byte {
 	return nil
 }
 
+func (m *Pack) GetMore() bool {
+	if m != nil && m.More != nil {
+		return *m.More
+	}
+	return false
+}
+
+func (m *Pack) GetTimeout() int32 {
+	if m != nil && m.Timeout != nil {
+		return *m.Timeout
+	}
+	return 0
+}
+
+func (m *Pack) GetMeta() []*Header {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
 func init() {
 }
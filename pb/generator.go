@@ -26,6 +26,18 @@ type Descriptor struct {
 	MethodName string
 	ArgType    string `type:"expr"`
 	ReplyType  string `type:"expr"`
+	Public     bool
+	Roles      []string
+	Stream     string `type:"expr"`
+	Idempotent bool
+	NewArgs    string `type:"expr"`
+	Handler    string `type:"expr"`
+}
+
+var streamKinds = map[string]string{
+	"server": "rpc.ServerStream",
+	"client": "rpc.ClientStream",
+	"bidi":   "rpc.BidiStream",
 }
 
 func printError(err error, msgs ...string) {
@@ -83,6 +95,16 @@ func genDescriptors(modules []parser.Module) []Descriptor {
 			} else {
 				d.ReplyType = "nil"
 			}
+			d.Public = service.HasAttr("public")
+			d.Roles = service.AttrValues("role")
+			if kinds := service.AttrValues("stream"); len(kinds) > 0 {
+				d.Stream = streamKinds[kinds[0]]
+			}
+			d.Idempotent = service.HasAttr("idempotent")
+			if !service.HasAttr("stream") {
+				d.NewArgs = "new" + dispatchName(module, service) + "Args"
+			}
+			d.Handler = "handle" + dispatchName(module, service)
 			a = append(a, d)
 		}
 	}
@@ -97,7 +119,10 @@ func serializeDescriptor(d Descriptor) string {
 		f := typ.Field(i)
 		var str string
 		fv := v.FieldByName(f.Name)
-		if f.Type.Kind() == reflect.String && f.Tag.Get("type") == "expr" {
+		if fv.IsZero() {
+			// omit optional attributes
+			continue
+		} else if f.Type.Kind() == reflect.String && f.Tag.Get("type") == "expr" {
 			str = fmt.Sprintf("%s:%s", f.Name, fv.String())
 		} else {
 			str = fmt.Sprintf("%s:%#v", f.Name, fv.Interface())
@@ -107,6 +132,102 @@ func serializeDescriptor(d Descriptor) string {
 	return strings.Join(a, ",\n")
 }
 
+// method name in module, e.g. Echo of Test.Echo
+func shortMethodName(service parser.Service) string {
+	return service.MethodName[strings.Index(service.MethodName, parser.NameSep)+1:]
+}
+
+// e.g. TestEcho of test.echo
+func dispatchName(module parser.Module, service parser.Service) string {
+	return module.GoName + shortMethodName(service)
+}
+
+// dispatch functions of every method, referred by NewArgs and Handler of descriptor
+func genHandlers(b *bytes.Buffer, modules []parser.Module) {
+	for _, module := range modules {
+		for _, service := range module.Services {
+			name := dispatchName(module, service)
+			method := shortMethodName(service)
+			if !service.HasAttr("stream") {
+				fmt.Fprintf(b, "func new%sArgs() (argv, reply interface{}) {\n", name)
+				if service.Output == "" {
+					fmt.Fprintf(b, "return new(%s), nil\n", service.Input)
+				} else {
+					fmt.Fprintf(b, "return new(%s), new(%s)\n", service.Input, service.Output)
+				}
+				b.WriteString("}\n\n")
+			}
+
+			// receiver is checked by registration, it may not implement the whole module interface
+			fmt.Fprintf(b, "func handle%s(rcvr interface{}, c *rpc.Context, argv, reply interface{}) *rpc.CallError {\n", name)
+			switch {
+			case service.HasAttr("stream"):
+				fmt.Fprintf(b, "return rcvr.(interface {\n%s(*rpc.Context, *rpc.Stream) *rpc.CallError\n}).%s(c, argv.(*rpc.Stream))\n", method, method)
+			case service.Output == "":
+				fmt.Fprintf(b, "rcvr.(interface {\n%s(*rpc.Context, *%s)\n}).%s(c, argv.(*%s))\n", method, service.Input, method, service.Input)
+				b.WriteString("return nil\n")
+			default:
+				fmt.Fprintf(b, "return rcvr.(interface {\n%s(*rpc.Context, *%s, *%s) *rpc.CallError\n}).%s(c, argv.(*%s), reply.(*%s))\n",
+					method, service.Input, service.Output, method, service.Input, service.Output)
+			}
+			b.WriteString("}\n\n")
+		}
+	}
+}
+
+// typed client of every module, e.g. TestClient.Echo
+func genClients(b *bytes.Buffer, modules []parser.Module) {
+	for _, module := range modules {
+		client := module.GoName + "Client"
+		fmt.Fprintf(b, "// typed client of module %s\n", module.Name)
+		fmt.Fprintf(b, "type %s struct {\ncaller rpc.Caller\n}\n\n", client)
+		fmt.Fprintf(b, "func New%s(caller rpc.Caller) *%s {\nreturn &%s{caller: caller}\n}\n\n", client, client, client)
+		for _, service := range module.Services {
+			method := shortMethodName(service)
+			switch {
+			case service.HasAttr("stream"):
+				fmt.Fprintf(b, "func (c *%s) %s(ctx context.Context) (*rpc.Stream, error) {\n", client, method)
+				fmt.Fprintf(b, "return c.caller.OpenStream(ctx, %q)\n", service.NormalName)
+			case service.Output == "":
+				fmt.Fprintf(b, "func (c *%s) %s(ctx context.Context, argv *%s) error {\n", client, method, service.Input)
+				fmt.Fprintf(b, "return c.caller.InvokeContext(ctx, %q, argv)\n", service.NormalName)
+			default:
+				fmt.Fprintf(b, "func (c *%s) %s(ctx context.Context, argv *%s) (*%s, error) {\n", client, method, service.Input, service.Output)
+				fmt.Fprintf(b, "reply := new(%s)\n", service.Output)
+				fmt.Fprintf(b, "callError, err := c.caller.CallContext(ctx, %q, argv, reply)\n", service.NormalName)
+				b.WriteString("if err != nil {\nreturn nil, err\n}\n")
+				b.WriteString("if callError != nil {\nreturn nil, callError\n}\n")
+				b.WriteString("return reply, nil\n")
+			}
+			b.WriteString("}\n\n")
+		}
+	}
+}
+
+// interface of every module and its register function, e.g. TestServer and RegisterTestServer
+func genServers(b *bytes.Buffer, modules []parser.Module) {
+	for _, module := range modules {
+		server := module.GoName + "Server"
+		fmt.Fprintf(b, "// services of module %s, implementation can have any type name\n", module.Name)
+		fmt.Fprintf(b, "type %s interface {\n", server)
+		for _, service := range module.Services {
+			method := shortMethodName(service)
+			switch {
+			case service.HasAttr("stream"):
+				fmt.Fprintf(b, "%s(c *rpc.Context, stream *rpc.Stream) *rpc.CallError\n", method)
+			case service.Output == "":
+				fmt.Fprintf(b, "%s(c *rpc.Context, argv *%s)\n", method, service.Input)
+			default:
+				fmt.Fprintf(b, "%s(c *rpc.Context, argv *%s, reply *%s) *rpc.CallError\n", method, service.Input, service.Output)
+			}
+		}
+		b.WriteString("}\n\n")
+		fmt.Fprintf(b, "func Register%s(r rpc.ServiceRegistrar, impl %s) error {\n", server, server)
+		fmt.Fprintf(b, "return r.RegisterService(%q, reflect.TypeOf((*%s)(nil)).Elem(), impl)\n", module.GoName, server)
+		b.WriteString("}\n\n")
+	}
+}
+
 func generate(modules []parser.Module) []byte {
 	b := new(bytes.Buffer)
 
@@ -123,6 +244,7 @@ func generate(modules []parser.Module) []byte {
 	// import
 	deps := genDependences(modules)
 	b.WriteString("import (\n")
+	b.WriteString("\"context\"\n")
 	b.WriteString("\"reflect\"\n")
 	b.WriteString("\n")
 	b.WriteString(fmt.Sprintf("%q\n", typ.PkgPath()))
@@ -147,6 +269,10 @@ func generate(modules []parser.Module) []byte {
 	b.WriteString("}\n")
 	b.WriteString("\n")
 
+	genHandlers(b, modules)
+	genClients(b, modules)
+	genServers(b, modules)
+
 	data, err := format.Source(b.Bytes())
 	if err != nil {
 		printError(err, "format output", b.String())
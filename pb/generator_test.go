@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	protolist "github.com/xjdrew/daisy/pb/parser"
+)
+
+const testProtolist = `
+test {
+    echo = 100001 @idempotent
+    strobe:[] = 100002
+    chat:echo = 100003 @stream(bidi)
+}
+`
+
+func TestGenerate(t *testing.T) {
+	modules, err := protolist.ParseData(testProtolist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := generate(modules)
+	if _, err := parser.ParseFile(token.NewFileSet(), "descriptor.go", data, 0); err != nil {
+		t.Fatalf("generated code doesn't parse: %v", err)
+	}
+
+	src := string(data)
+	for _, expect := range []string{
+		"Idempotent: true,",
+		"Stream:     rpc.BidiStream,",
+		"Handler:    handleTestEcho,",
+		"func (c *TestClient) Echo(ctx context.Context, argv *proto_test.Echo) (*proto_test.Echo_Response, error) {",
+		"func (c *TestClient) Strobe(ctx context.Context, argv *proto_test.Strobe) error {",
+		"func (c *TestClient) Chat(ctx context.Context) (*rpc.Stream, error) {",
+		"Echo(c *rpc.Context, argv *proto_test.Echo, reply *proto_test.Echo_Response) *rpc.CallError\n",
+		"Strobe(c *rpc.Context, argv *proto_test.Strobe)\n",
+		"Chat(c *rpc.Context, stream *rpc.Stream) *rpc.CallError\n",
+		"func RegisterTestServer(r rpc.ServiceRegistrar, impl TestServer) error {",
+	} {
+		if !strings.Contains(src, expect) {
+			t.Errorf("generated code has no %q", expect)
+		}
+	}
+	// streaming method has no NewArgs
+	if strings.Contains(src, "newTestChatArgs") {
+		t.Error("streaming method should not have NewArgs")
+	}
+}
+
+// checked in descriptors are generated from protolist of contrib
+func TestGeneratedUpToDate(t *testing.T) {
+	data, err := ioutil.ReadFile("../contrib/proto/service.protolist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := protolist.ParseData(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := ioutil.ReadFile("../gen/descriptor/descriptor.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generate(modules), expect) {
+		t.Fatal("gen/descriptor/descriptor.go is out of date, run the generator again")
+	}
+}
@@ -9,6 +9,11 @@ import (
 )
 
 // exported struct
+type Attribute struct {
+	Name  string
+	Value string
+}
+
 type Service struct {
 	Id         int32
 	Name       string
@@ -16,6 +21,7 @@ type Service struct {
 	MethodName string
 	Input      string
 	Output     string
+	Attrs      []Attribute
 }
 
 type Module struct {
@@ -140,7 +146,7 @@ func normalizeModules(modules []Module) error {
 				return fmt.Errorf("repeated service:(%s:%d)", service.Name, service.Id)
 			}
 			idMap[service.Id] = true
-			service.Name, serviceMap[service.Name] = service.Name, true
+			serviceMap[service.Name] = true
 		}
 		normalizeModule(module)
 	}
@@ -252,17 +258,81 @@ func checkOutput(str string) bool {
 	return checkInput(str[1 : len(str)-1])
 }
 
+// attributes
+// @public: callable without authentication
+// @role(name,...): callable by principal who has one of the roles
+// @stream(server|client|bidi): streaming method, which side sends a stream of messages
+// @idempotent: method can be retried safely
+var knownAttributes = map[string]bool{
+	"public":     false, // name -> has value
+	"role":       true,
+	"stream":     true,
+	"idempotent": false,
+}
+
+var streamKinds = map[string]bool{
+	"server": true,
+	"client": true,
+	"bidi":   true,
+}
+
 // name = id
 // name:input = id
 // name:input[] = id
 // name:input[output] = id
 // name:[output] = id
 // name:[] = id
-var serviceRegex = regexp.MustCompile("^\\s*([a-zA-Z0-9\\._]+)\\s*(?:\\:\\s*([a-zA-Z0-9\\._]*)\\s*(\\[\\s*[a-zA-Z0-9\\._]*\\s*\\])?)?\\s*=\\s*([0-9]+)\\s*$")
+// any of above followed by attributes: name = id @attr @attr(value)
+var serviceRegex = regexp.MustCompile("^\\s*([a-zA-Z0-9\\._]+)\\s*(?:\\:\\s*([a-zA-Z0-9\\._]*)\\s*(\\[\\s*[a-zA-Z0-9\\._]*\\s*\\])?)?\\s*=\\s*([0-9]+)((?:\\s+@[^@]*)*)\\s*$")
+
+var attributeRegex = regexp.MustCompile("^@([a-z][a-z0-9_]*)(?:\\(\\s*([a-zA-Z0-9_\\.,\\s]*?)\\s*\\))?$")
+
+func parseAttributes(data string) ([]Attribute, error) {
+	var attrs []Attribute
+	for _, field := range strings.Split(data, "@")[1:] {
+		str := "@" + strings.TrimSpace(field)
+		sections := attributeRegex.FindStringSubmatch(str)
+		if sections == nil {
+			return nil, fmt.Errorf("invalid attribute(%s)", str)
+		}
+		hasValue, ok := knownAttributes[sections[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown attribute(%s)", str)
+		}
+		if hasValue != (sections[2] != "") {
+			return nil, fmt.Errorf("invalid attribute value(%s)", str)
+		}
+		attrs = append(attrs, Attribute{Name: sections[1], Value: sections[2]})
+	}
+	return attrs, nil
+}
+
+// values of attribute name, a value may be a comma separated list
+func (s *Service) AttrValues(name string) []string {
+	var a []string
+	for _, attr := range s.Attrs {
+		if attr.Name != name {
+			continue
+		}
+		for _, v := range strings.Split(attr.Value, ",") {
+			a = appendString(a, v)
+		}
+	}
+	return a
+}
+
+func (s *Service) HasAttr(name string) bool {
+	for _, attr := range s.Attrs {
+		if attr.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
 func parseService(data string) (s Service, err error) {
 	sections := serviceRegex.FindStringSubmatch(data)
-	if sections == nil || len(sections) != 5 {
+	if sections == nil || len(sections) != 6 {
 		err = fmt.Errorf("invalid service(%s)", data)
 		return
 	}
@@ -291,6 +361,21 @@ func parseService(data string) (s Service, err error) {
 		err = fmt.Errorf("invalid output format:%s", s.Output)
 		return
 	}
+	if s.Attrs, err = parseAttributes(sections[5]); err != nil {
+		err = fmt.Errorf("%s in line %s", err.Error(), data)
+		return
+	}
+	if s.HasAttr("stream") {
+		kinds := s.AttrValues("stream")
+		if len(kinds) != 1 || !streamKinds[kinds[0]] {
+			err = fmt.Errorf("invalid stream kind:%v in line %s", kinds, data)
+			return
+		}
+		if s.Output == EMPTY_OUTPUT {
+			err = fmt.Errorf("stream should have output in line %s", data)
+			return
+		}
+	}
 	return
 }
 
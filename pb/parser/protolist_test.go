@@ -71,19 +71,25 @@ var case1 = Case{
 		"service6:[]=6",
 		"service7:.proto.test2.Service7 = 7",
 		"service8:.proto.test2.Service7 [.proto.test2.Service8]= 8",
+		"service9:[] = 9 @public",
+		"service10 = 10 @role(admin, gm) @role(ops)",
 		"}",
 	},
 	module: Module{
 		Name: "test",
 		Services: []Service{
-			{1, "service1", "proto_test.Service1", "proto_test.Service1_Response"},
-			{2, "service2", "proto_test.Input1", "proto_test.Input1_Response"},
-			{3, "service3", "proto_test.Input1", ""},
-			{4, "service4", "proto_test.Input1", "proto_test.Output1"},
-			{5, "service5", "proto_test.Service5", "proto_test.Output1"},
-			{6, "service6", "proto_test.Service6", ""},
-			{7, "service7", "proto_test2.Service7", "proto_test2.Service7_Response"},
-			{8, "service8", "proto_test2.Service7", "proto_test2.Service8"},
+			{Id: 1, Name: "service1", Input: "proto_test.Service1", Output: "proto_test.Service1_Response"},
+			{Id: 2, Name: "service2", Input: "proto_test.Input1", Output: "proto_test.Input1_Response"},
+			{Id: 3, Name: "service3", Input: "proto_test.Input1", Output: ""},
+			{Id: 4, Name: "service4", Input: "proto_test.Input1", Output: "proto_test.Output1"},
+			{Id: 5, Name: "service5", Input: "proto_test.Service5", Output: "proto_test.Output1"},
+			{Id: 6, Name: "service6", Input: "proto_test.Service6", Output: ""},
+			{Id: 7, Name: "service7", Input: "proto_test2.Service7", Output: "proto_test2.Service7_Response"},
+			{Id: 8, Name: "service8", Input: "proto_test2.Service7", Output: "proto_test2.Service8"},
+			{Id: 9, Name: "service9", Input: "proto_test.Service9", Output: "",
+				Attrs: []Attribute{{Name: "public"}}},
+			{Id: 10, Name: "service10", Input: "proto_test.Service10", Output: "proto_test.Service10_Response",
+				Attrs: []Attribute{{Name: "role", Value: "admin, gm"}, {Name: "role", Value: "ops"}}},
 		},
 	},
 }
@@ -102,12 +108,12 @@ var case2 = Case{
 	module: Module{
 		Name: "test1",
 		Services: []Service{
-			{11, "service11", "proto_test1.Service11", "proto_test1.Service11_Response"},
-			{12, "service12", "proto_test1.Input1", "proto_test1.Input1_Response"},
-			{13, "service13", "proto_test1.Input1", ""},
-			{14, "service14", "proto_test1.Input1", "proto_test1.Output1"},
-			{15, "service15", "proto_test1.Service15", "proto_test1.Output1"},
-			{16, "service16", "proto_test1.Service16", ""},
+			{Id: 11, Name: "service11", Input: "proto_test1.Service11", Output: "proto_test1.Service11_Response"},
+			{Id: 12, Name: "service12", Input: "proto_test1.Input1", Output: "proto_test1.Input1_Response"},
+			{Id: 13, Name: "service13", Input: "proto_test1.Input1", Output: ""},
+			{Id: 14, Name: "service14", Input: "proto_test1.Input1", Output: "proto_test1.Output1"},
+			{Id: 15, Name: "service15", Input: "proto_test1.Service15", Output: "proto_test1.Output1"},
+			{Id: 16, Name: "service16", Input: "proto_test1.Service16", Output: ""},
 		},
 	},
 }
@@ -119,6 +125,16 @@ func checkService(s1, s2 Service) bool {
 		fmt.Printf("service:%+v -> %+v\n", s1, s2)
 		return false
 	}
+	if len(s1.Attrs) != len(s2.Attrs) {
+		fmt.Printf("service attrs:%+v -> %+v\n", s1, s2)
+		return false
+	}
+	for i := range s1.Attrs {
+		if s1.Attrs[i] != s2.Attrs[i] {
+			fmt.Printf("service attrs:%+v -> %+v\n", s1, s2)
+			return false
+		}
+	}
 	return true
 }
 
@@ -153,6 +169,48 @@ func TestParseModule(t *testing.T) {
 	}
 }
 
+func TestParseAttributes(t *testing.T) {
+	s, err := parseService("service10 = 10 @role(admin, gm) @role(ops)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := s.AttrValues("role")
+	if strings.Join(roles, ",") != "admin,gm,ops" {
+		t.Fatalf("unexpected roles: %v", roles)
+	}
+	if s.HasAttr("public") || s.HasAttr("idempotent") {
+		t.Fatal("unexpected attribute")
+	}
+	if s, err = parseService("service12 = 12 @idempotent @public"); err != nil || !s.HasAttr("idempotent") {
+		t.Fatalf("parse idempotent failed: %v", err)
+	}
+
+	s, err = parseService("service11:input1[output1] = 11 @stream(bidi)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds := s.AttrValues("stream"); len(kinds) != 1 || kinds[0] != "bidi" {
+		t.Fatalf("unexpected stream kind: %v", kinds)
+	}
+
+	for _, line := range []string{
+		"service1 = 1 @unknown",
+		"service1 = 1 @public(x)",
+		"service1 = 1 @idempotent(true)",
+		"service1 = 1 @role",
+		"service1 = 1 @role()",
+		"service1 = 1 public",
+		"service1 = 1 @stream(both)",
+		"service1 = 1 @stream(server,client)",
+		"service1:[] = 1 @stream(bidi)",
+		"service1 = 1@public",
+	} {
+		if _, err := parseService(line); err == nil {
+			t.Errorf("parse %q should fail", line)
+		}
+	}
+}
+
 func TestParseFile(t *testing.T) {
 	tmpfile, err := ioutil.TempFile(os.TempDir(), "proto")
 	if err != nil {
@@ -0,0 +1,321 @@
+package rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/base"
+)
+
+/*
+	authentication handshake
+	client sends auth frames, server replies each of them with an auth frame:
+	error set means failed, non-empty data is a challenge, otherwise authenticated.
+	frames of a handshake carry its id in session, so replies of an abandoned
+	handshake are dropped. requests are rejected until the handshake completes
+*/
+
+// authenticated peer
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// server side of handshake
+type Authenticator interface {
+	// start handshake of a connection
+	NewSession(c *Context) AuthSession
+}
+
+type AuthSession interface {
+	// handle a message from peer, return principal when authenticated,
+	// or a non-empty challenge to continue
+	Next(data []byte) (*Principal, []byte, error)
+}
+
+// client side of handshake
+type Credentials interface {
+	// first message sent to server
+	Initial() ([]byte, error)
+	// response of a server challenge
+	Respond(challenge []byte) ([]byte, error)
+}
+
+var ErrAuthFailed = errors.New("rpc: authentication failed")
+
+// require peer to authenticate before calling services, should be called before the context is served
+func (c *Context) SetAuthenticator(a Authenticator) {
+	c.authenticator = a
+}
+
+// authenticated peer, nil if not authenticated
+func (c *Context) Principal() *Principal {
+	p, _ := c.principal.Load().(*Principal)
+	return p
+}
+
+// peer can call services
+func (c *Context) authenticated() bool {
+	return c.authenticator == nil || c.Principal() != nil
+}
+
+// check access attributes of method against principal
+func (c *Context) authorize(dptor *Descriptor) *CallError {
+	if dptor.Public {
+		return nil
+	}
+	if !c.authenticated() {
+		return NewCallError(ErrCodeUnauthenticated, "authentication required")
+	}
+	if len(dptor.Roles) == 0 {
+		return nil
+	}
+	p := c.Principal()
+	for _, role := range dptor.Roles {
+		if p.HasRole(role) {
+			return nil
+		}
+	}
+	return NewCallError(ErrCodePermissionDenied, "%s requires role %s", dptor.NormalName, strings.Join(dptor.Roles, "|"))
+}
+
+// handle auth frame from client
+func (c *Context) serveAuth(pack *proto_base.Pack) bool {
+	if c.authenticator == nil {
+		return c.owner.onUnknownPack(c, pack)
+	}
+	if c.authSession == nil || pack.GetSession() != c.authServing {
+		// client starts over
+		c.authSession = c.authenticator.NewSession(c)
+		c.authServing = pack.GetSession()
+	}
+
+	var reply proto_base.Pack
+	reply.Session = pack.Session
+	reply.Type = proto.Int32(typeAuth)
+	principal, challenge, err := c.authSession.Next(pack.GetData())
+	switch {
+	case err != nil:
+		// client may start over
+		c.authSession = nil
+		reply.Error = &proto_base.Error{
+			Failed: proto.Bool(true),
+			Code:   proto.Int32(ErrCodeUnauthenticated),
+			Error:  proto.String(err.Error()),
+		}
+	case principal != nil:
+		c.authSession = nil
+		c.principal.Store(principal)
+	case len(challenge) > 0:
+		reply.Data = challenge
+	default:
+		c.authSession = nil
+		reply.Error = &proto_base.Error{
+			Failed: proto.Bool(true),
+			Code:   proto.Int32(ErrCodeUnauthenticated),
+			Error:  proto.String("empty challenge"),
+		}
+	}
+	c.writePack(&reply, frameOther)
+	return true
+}
+
+// handle auth frame from server
+func (c *Context) dispatchAuthReply(pack *proto_base.Pack) bool {
+	if pack.GetSession() != atomic.LoadInt32(&c.authId) {
+		log.Printf("drop auth reply of handshake %d", pack.GetSession())
+		return true
+	}
+	select {
+	case c.authReply <- pack:
+		return true
+	default:
+		return c.owner.onUnknownPack(c, pack)
+	}
+}
+
+/*
+	authenticate to peer, Serve must have been started.
+	block until the handshake completes, fails or ctx is done
+*/
+func (c *Context) Authenticate(ctx context.Context, creds Credentials) error {
+	c.authLock.Lock()
+	defer c.authLock.Unlock()
+
+	// reply of a given up handshake may fill the buffer, drop it
+	id := atomic.AddInt32(&c.authId, 1)
+	select {
+	case <-c.authReply:
+	default:
+	}
+
+	data, err := creds.Initial()
+	for err == nil {
+		var pack proto_base.Pack
+		pack.Session = proto.Int32(id)
+		pack.Type = proto.Int32(typeAuth)
+		pack.Data = data
+		if err = c.writePack(&pack, frameOther); err != nil {
+			break
+		}
+
+		reply, callError := c.waitAuthReply(ctx, id)
+		if callError != nil {
+			return callError
+		}
+		if reply.GetError().GetFailed() {
+			return NewRpcCallError(reply.GetError().GetCode(), reply.GetError().GetError())
+		}
+		if len(reply.GetData()) == 0 {
+			return nil
+		}
+		data, err = creds.Respond(reply.GetData())
+	}
+	return err
+}
+
+// reply of handshake id, replies of abandoned handshakes are skipped
+func (c *Context) waitAuthReply(ctx context.Context, id int32) (*proto_base.Pack, *CallError) {
+	for {
+		select {
+		case reply := <-c.authReply:
+			if reply.GetSession() == id {
+				return reply, nil
+			}
+		case <-ctx.Done():
+			return nil, contextCallError(ctx.Err())
+		case <-c.endpoint.ctx.Done():
+			return nil, NewCallError(ErrCodeUnavailable, "connection down")
+		}
+	}
+}
+
+// plain token
+type tokenAuthenticator struct {
+	verify func(token string) (*Principal, error)
+}
+
+type tokenSession struct {
+	*tokenAuthenticator
+}
+
+// authenticate by token, verify returns principal of a valid token
+func TokenAuthenticator(verify func(token string) (*Principal, error)) Authenticator {
+	return &tokenAuthenticator{verify: verify}
+}
+
+func (a *tokenAuthenticator) NewSession(c *Context) AuthSession {
+	return tokenSession{a}
+}
+
+func (s tokenSession) Next(data []byte) (*Principal, []byte, error) {
+	principal, err := s.verify(string(data))
+	if err == nil && principal == nil {
+		err = ErrAuthFailed
+	}
+	return principal, nil, err
+}
+
+type TokenCredentials string
+
+func (t TokenCredentials) Initial() ([]byte, error) {
+	return []byte(t), nil
+}
+
+func (t TokenCredentials) Respond(challenge []byte) ([]byte, error) {
+	return nil, errors.New("token credentials: unexpected challenge")
+}
+
+/*
+	HMAC challenge-response
+	client sends its name, server replies a random nonce,
+	client proves it knows the secret by HMAC-SHA256(secret, nonce)
+*/
+const hmacNonceSize = 32
+
+type hmacAuthenticator struct {
+	lookup func(name string) (secret []byte, principal *Principal, err error)
+}
+
+type hmacSession struct {
+	*hmacAuthenticator
+	secret    []byte
+	principal *Principal
+	nonce     []byte
+}
+
+// lookup returns secret and principal of name
+func HMACAuthenticator(lookup func(name string) (secret []byte, principal *Principal, err error)) Authenticator {
+	return &hmacAuthenticator{lookup: lookup}
+}
+
+func (a *hmacAuthenticator) NewSession(c *Context) AuthSession {
+	return &hmacSession{hmacAuthenticator: a}
+}
+
+func (s *hmacSession) Next(data []byte) (*Principal, []byte, error) {
+	if s.nonce == nil {
+		secret, principal, err := s.lookup(string(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		if principal == nil {
+			return nil, nil, ErrAuthFailed
+		}
+		nonce := make([]byte, hmacNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, err
+		}
+		s.secret, s.principal, s.nonce = secret, principal, nonce
+		return nil, nonce, nil
+	}
+
+	if !hmac.Equal(data, hmacSum(s.secret, s.nonce)) {
+		return nil, nil, ErrAuthFailed
+	}
+	return s.principal, nil, nil
+}
+
+func hmacSum(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+type hmacCredentials struct {
+	name   string
+	secret []byte
+}
+
+func HMACCredentials(name string, secret []byte) Credentials {
+	return &hmacCredentials{name: name, secret: secret}
+}
+
+func (h *hmacCredentials) Initial() ([]byte, error) {
+	return []byte(h.name), nil
+}
+
+func (h *hmacCredentials) Respond(challenge []byte) ([]byte, error) {
+	return hmacSum(h.secret, challenge), nil
+}
+
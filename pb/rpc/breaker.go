@@ -0,0 +1,285 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	circuit breaker of outgoing calls
+	every target/method has a circuit. a closed circuit counts results in Window,
+	and opens when error rate or timeout rate reaches threshold. an open circuit
+	fails calls with ErrCodeCircuitOpen at once, and half-opens after OpenTimeout.
+	a half-open circuit lets HalfOpenProbes calls through: the first success
+	closes it, the first failure opens it again.
+	failures are the same as Pool: connection errors, timeouts, unavailable or
+	overloaded peer. errors returned by services are successes.
+
+	usage: rpc.InterceptOutgoing(breaker.Interceptor())
+*/
+type BreakerState int32
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultBreakerWindow      = 10 * time.Second
+	DefaultBreakerMinRequests = 20
+	DefaultBreakerErrorRate   = 0.5
+	DefaultBreakerOpenTimeout = 5 * time.Second
+)
+
+// zero value is ready to use, fields should be set before use
+type CircuitBreaker struct {
+	Window      time.Duration // DefaultBreakerWindow if zero
+	MinRequests int           // circuit doesn't open before MinRequests in window, DefaultBreakerMinRequests if zero
+	ErrorRate   float64       // DefaultBreakerErrorRate if zero
+	TimeoutRate float64       // rate of timeouts, disabled if zero
+	OpenTimeout time.Duration // DefaultBreakerOpenTimeout if zero
+	// concurrent calls allowed in half-open state, 1 if zero
+	HalfOpenProbes int
+	// circuit of a call, "remote address/method" if nil, e.g. "127.0.0.1:9000/test.echo"
+	Key func(c *Context, dptor *Descriptor) string
+	// called after state of a circuit changes
+	OnStateChange func(key string, state BreakerState)
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    BreakerState
+	since    time.Time // start of window if closed, time of opening if open
+	requests int
+	failures int
+	timeouts int
+	probes   int // running probes if half-open
+}
+
+type callOutcome int
+
+const (
+	outcomeIgnored callOutcome = iota // canceled by caller
+	outcomeSuccess
+	outcomeFailure
+	outcomeTimeout
+)
+
+func classifyCall(callError *CallError) callOutcome {
+	switch {
+	case callError.IsTimeout():
+		return outcomeTimeout
+	case isBackendFailure(callError):
+		return outcomeFailure
+	case callError.IsCanceled():
+		return outcomeIgnored
+	}
+	return outcomeSuccess
+}
+
+// ClientInterceptor which applies the breaker
+func (cb *CircuitBreaker) Interceptor() ClientInterceptor {
+	return func(c *Context, call *Call, invoker Invoker) error {
+		key := cb.key(c, call.Dptor)
+		probe, ok := cb.allow(key)
+		if !ok {
+			return NewCallError(ErrCodeCircuitOpen, "circuit %s is open", key)
+		}
+
+		if !call.Dptor.HasReply() {
+			// invoke succeeds once it's written
+			err := invoker(c, call)
+			if err != nil {
+				cb.finish(key, probe, classifyCall(writeCallError(err)))
+			} else {
+				cb.finish(key, probe, outcomeSuccess)
+			}
+			return err
+		}
+
+		call.OnDone(func(call *Call) {
+			cb.finish(key, probe, classifyCall(call.Error))
+		})
+		err := invoker(c, call)
+		if _, ok := err.(*CallError); err != nil && !ok {
+			// call is not sent and never done
+			cb.finish(key, probe, outcomeIgnored)
+		}
+		return err
+	}
+}
+
+// state of circuit, BreakerClosed if no call is made
+func (cb *CircuitBreaker) State(key string) BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if ct, ok := cb.circuits[key]; ok {
+		return ct.state
+	}
+	return BreakerClosed
+}
+
+// states of all circuits, for monitoring
+func (cb *CircuitBreaker) States() map[string]BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	states := make(map[string]BreakerState, len(cb.circuits))
+	for key, ct := range cb.circuits {
+		states[key] = ct.state
+	}
+	return states
+}
+
+func (cb *CircuitBreaker) key(c *Context, dptor *Descriptor) string {
+	if cb.Key != nil {
+		return cb.Key(c, dptor)
+	}
+	return c.RemoteAddr().String() + "/" + dptor.NormalName
+}
+
+func (cb *CircuitBreaker) window() time.Duration {
+	if cb.Window > 0 {
+		return cb.Window
+	}
+	return DefaultBreakerWindow
+}
+
+func (cb *CircuitBreaker) openTimeout() time.Duration {
+	if cb.OpenTimeout > 0 {
+		return cb.OpenTimeout
+	}
+	return DefaultBreakerOpenTimeout
+}
+
+// check whether a call can go, probe is true if it's a probe of half-open circuit
+func (cb *CircuitBreaker) allow(key string) (probe bool, ok bool) {
+	now := time.Now()
+	cb.mu.Lock()
+	if cb.circuits == nil {
+		cb.circuits = make(map[string]*circuit)
+	}
+	ct := cb.circuits[key]
+	if ct == nil {
+		ct = &circuit{state: BreakerClosed, since: now}
+		cb.circuits[key] = ct
+	}
+
+	from := ct.state
+	switch ct.state {
+	case BreakerClosed:
+		ok = true
+	case BreakerOpen:
+		if now.Sub(ct.since) < cb.openTimeout() {
+			break
+		}
+		ct.state = BreakerHalfOpen
+		ct.probes = 0
+		fallthrough
+	case BreakerHalfOpen:
+		max := cb.HalfOpenProbes
+		if max <= 0 {
+			max = 1
+		}
+		if ct.probes < max {
+			ct.probes++
+			probe, ok = true, true
+		}
+	}
+	to := ct.state
+	cb.mu.Unlock()
+
+	cb.changed(key, from, to)
+	return
+}
+
+// record result of a call
+func (cb *CircuitBreaker) finish(key string, probe bool, outcome callOutcome) {
+	now := time.Now()
+	cb.mu.Lock()
+	ct := cb.circuits[key]
+	from := ct.state
+	switch ct.state {
+	case BreakerClosed:
+		if outcome == outcomeIgnored {
+			break
+		}
+		if now.Sub(ct.since) >= cb.window() {
+			ct.reset(now)
+		}
+		ct.requests++
+		if outcome == outcomeFailure || outcome == outcomeTimeout {
+			ct.failures++
+		}
+		if outcome == outcomeTimeout {
+			ct.timeouts++
+		}
+		if cb.tripped(ct) {
+			ct.state = BreakerOpen
+			ct.since = now
+		}
+	case BreakerHalfOpen:
+		// results of calls allowed before circuit opens are ignored
+		if !probe {
+			break
+		}
+		ct.probes--
+		switch outcome {
+		case outcomeSuccess:
+			ct.state = BreakerClosed
+			ct.reset(now)
+		case outcomeFailure, outcomeTimeout:
+			ct.state = BreakerOpen
+			ct.since = now
+		}
+	}
+	to := ct.state
+	cb.mu.Unlock()
+
+	cb.changed(key, from, to)
+}
+
+func (cb *CircuitBreaker) tripped(ct *circuit) bool {
+	min := cb.MinRequests
+	if min <= 0 {
+		min = DefaultBreakerMinRequests
+	}
+	if ct.requests < min {
+		return false
+	}
+	errorRate := cb.ErrorRate
+	if errorRate <= 0 {
+		errorRate = DefaultBreakerErrorRate
+	}
+	if float64(ct.failures)/float64(ct.requests) >= errorRate {
+		return true
+	}
+	return cb.TimeoutRate > 0 && float64(ct.timeouts)/float64(ct.requests) >= cb.TimeoutRate
+}
+
+func (cb *CircuitBreaker) changed(key string, from, to BreakerState) {
+	if from != to && cb.OnStateChange != nil {
+		cb.OnStateChange(key, to)
+	}
+}
+
+func (ct *circuit) reset(now time.Time) {
+	ct.since = now
+	ct.requests = 0
+	ct.failures = 0
+	ct.timeouts = 0
+}
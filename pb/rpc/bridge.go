@@ -56,6 +56,16 @@ func (bridge *Bridge) getDescriptorByName(name string) *Descriptor {
 	return bridge.nameMap[name]
 }
 
+// module is the name in protolist, e.g. "test"
+func (bridge *Bridge) hasModule(module string) bool {
+	for _, dptor := range bridge.idMap {
+		if dptor.Module() == module {
+			return true
+		}
+	}
+	return false
+}
+
 func (bridge *Bridge) getDescriptor(module, method string) *Descriptor {
 	return bridge.methodMap[module+"."+method]
 }
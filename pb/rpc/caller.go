@@ -0,0 +1,16 @@
+package rpc
+
+import "context"
+
+// methods shared by Context, ReconnectClient and Pool, used by generated clients
+type Caller interface {
+	CallContext(ctx context.Context, method string, argv interface{}, reply interface{}) (*CallError, error)
+	InvokeContext(ctx context.Context, method string, argv interface{}) error
+	OpenStream(ctx context.Context, method string) (*Stream, error)
+}
+
+var (
+	_ Caller = (*Context)(nil)
+	_ Caller = (*ReconnectClient)(nil)
+	_ Caller = (*Pool)(nil)
+)
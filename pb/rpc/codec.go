@@ -1,9 +1,11 @@
 package rpc
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync/atomic"
 
 	"github.com/golang/protobuf/proto"
 
@@ -11,17 +13,205 @@ import (
 )
 
 const (
-	BUFLEN = 65535
+	BUFLEN = 65535 // max frame size of legacy uint16 framing
+
+	DefaultMaxFrameSize = 16 << 20
+)
+
+/*
+	帧长度前缀格式
+	连接建立时默认使用uint16(兼容老客户端)，新客户端可以发送协商包切换到其他格式
+	协商包: 0x00 0x00 version framing uvarint(max frame size)
+	老客户端不会发送长度为0的包，所以服务器可以据此区分
+	max frame size是发送方能接收的最大帧，对方按它和自己的限制中较小的值分片
+	每个方向独立切换：发送协商包之后的帧使用新格式，收到对方协商包之后按新格式读。
+	收到协商包的一方如果还没有发送过，回复一个相同格式的协商包作为确认
+*/
+type Framing uint8
+
+const (
+	FramingUint16 Framing = iota // 2 bytes big endian, legacy
+	FramingUint32                // 4 bytes big endian
+	FramingVarint                // unsigned varint
 )
 
+const protocolVersion = 2
+
+func (f Framing) String() string {
+	switch f {
+	case FramingUint16:
+		return "uint16"
+	case FramingUint32:
+		return "uint32"
+	case FramingVarint:
+		return "varint"
+	}
+	return fmt.Sprintf("Framing(%d)", uint8(f))
+}
+
+func (f Framing) limit() int {
+	if f == FramingUint16 {
+		return BUFLEN
+	}
+	return int(^uint32(0) >> 1)
+}
+
 type Codec struct {
-	rwc   io.ReadWriteCloser
-	rdbuf [BUFLEN]byte
+	rwc      io.ReadWriteCloser
+	rd       *bufio.Reader
+	wr       *bufio.Writer
+	rdbuf    []byte
+	maxFrame int
+
+	// accessed atomically, read side is set by reader, write side by writer
+	readFraming  int32
+	writeFraming int32
+	negotiated   int32 // preamble is sent or received
+	accepted     int32 // preamble of peer is received
+	peerMaxFrame int64 // max frame size of peer, 0 if unknown
+
+	// called by reader when preamble of peer is read
+	onPreamble func(Framing)
 }
 
 func NewCodec(rwc io.ReadWriteCloser) *Codec {
 	return &Codec{
-		rwc: rwc,
+		rwc:      rwc,
+		rd:       bufio.NewReader(rwc),
+		wr:       bufio.NewWriter(rwc),
+		maxFrame: DefaultMaxFrameSize,
+	}
+}
+
+// framing of frames read from peer
+func (c *Codec) Framing() Framing {
+	return Framing(atomic.LoadInt32(&c.readFraming))
+}
+
+// framing of frames written to peer
+func (c *Codec) outFraming() Framing {
+	return Framing(atomic.LoadInt32(&c.writeFraming))
+}
+
+// peer speaks the negotiated protocol
+func (c *Codec) Negotiated() bool {
+	return atomic.LoadInt32(&c.negotiated) != 0
+}
+
+// preamble of peer is received
+func (c *Codec) peerNegotiated() bool {
+	return atomic.LoadInt32(&c.accepted) != 0
+}
+
+// max size of frames read, bounded by framing
+func (c *Codec) MaxFrameSize() int {
+	if limit := c.Framing().limit(); c.maxFrame > limit {
+		return limit
+	}
+	return c.maxFrame
+}
+
+// max size of frames written, bounded by framing and limit of peer.
+// max frame size of this side is used if peer doesn't tell
+func (c *Codec) maxWriteFrameSize() int {
+	n := c.maxFrame
+	if peer := int(atomic.LoadInt64(&c.peerMaxFrame)); peer > 0 {
+		n = peer
+	}
+	if limit := c.outFraming().limit(); n > limit {
+		return limit
+	}
+	return n
+}
+
+// should be called before Negotiate, which tells peer the size
+func (c *Codec) SetMaxFrameSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxFrameSize
+	}
+	c.maxFrame = n
+}
+
+// buffer negotiation preamble, packs written after it use framing f.
+// it's sent with next Flush, and must be written by the goroutine which writes packs
+func (c *Codec) Negotiate(f Framing) error {
+	if f > FramingVarint {
+		return fmt.Errorf("Negotiate: unknown framing %s", f)
+	}
+	if c.outFraming() != FramingUint16 {
+		return fmt.Errorf("Negotiate: framing is already %s", c.outFraming())
+	}
+	maxFrame := c.maxFrame
+	if limit := f.limit(); maxFrame > limit {
+		maxFrame = limit
+	}
+	preamble := []byte{0, 0, protocolVersion, byte(f)}
+	preamble = binary.AppendUvarint(preamble, uint64(maxFrame))
+	if _, err := c.wr.Write(preamble); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.writeFraming, int32(f))
+	atomic.StoreInt32(&c.negotiated, 1)
+	return nil
+}
+
+// read preamble after a zero length prefix
+func (c *Codec) acceptPreamble() error {
+	var preamble [2]byte
+	if _, err := io.ReadFull(c.rd, preamble[:]); err != nil {
+		return err
+	}
+	if preamble[0] != protocolVersion {
+		return fmt.Errorf("ReadPack: unsupported protocol version(%d)", preamble[0])
+	}
+	f := Framing(preamble[1])
+	if f > FramingVarint {
+		return fmt.Errorf("ReadPack: unknown framing(%d)", preamble[1])
+	}
+	maxFrame, err := binary.ReadUvarint(c.rd)
+	if err != nil {
+		return err
+	}
+	if maxFrame == 0 || maxFrame > uint64(f.limit()) {
+		return fmt.Errorf("ReadPack: invalid max frame size(%d)", maxFrame)
+	}
+	atomic.StoreInt64(&c.peerMaxFrame, int64(maxFrame))
+	atomic.StoreInt32(&c.readFraming, int32(f))
+	atomic.StoreInt32(&c.negotiated, 1)
+	atomic.StoreInt32(&c.accepted, 1)
+	if c.onPreamble != nil {
+		c.onPreamble(f)
+	}
+	return nil
+}
+
+func (c *Codec) readSize() (int, error) {
+	framing := c.Framing()
+	switch framing {
+	case FramingUint16:
+		var sz uint16
+		if err := binary.Read(c.rd, binary.BigEndian, &sz); err != nil {
+			return 0, err
+		}
+		return int(sz), nil
+	case FramingUint32:
+		var sz uint32
+		if err := binary.Read(c.rd, binary.BigEndian, &sz); err != nil {
+			return 0, err
+		}
+		if sz > uint32(framing.limit()) {
+			return 0, fmt.Errorf("ReadPack: overflow packet size(%d)", sz)
+		}
+		return int(sz), nil
+	default:
+		sz, err := binary.ReadUvarint(c.rd)
+		if err != nil {
+			return 0, err
+		}
+		if sz > uint64(framing.limit()) {
+			return 0, fmt.Errorf("ReadPack: overflow packet size(%d)", sz)
+		}
+		return int(sz), nil
 	}
 }
 
@@ -30,28 +220,46 @@ func (c *Codec) ReadPack(p *proto_base.Pack) error {
 		return nil
 	}
 
-	var sz uint16
-	if err := binary.Read(c.rwc, binary.BigEndian, &sz); err != nil {
+	sz, err := c.readSize()
+	if err != nil {
 		return err
 	}
 
-	var to uint16 = 0
-	rdbuf := c.rdbuf[:sz]
-	for to < sz {
-		n, err := c.rwc.Read(rdbuf[to:])
-		if err != nil {
+	// legacy peer never sends an empty frame, so it's the preamble
+	if sz == 0 && !c.peerNegotiated() && c.Framing() == FramingUint16 {
+		if err = c.acceptPreamble(); err != nil {
 			return err
 		}
-		to += uint16(n)
+		return c.ReadPack(p)
+	}
+
+	if sz > c.MaxFrameSize() {
+		return fmt.Errorf("ReadPack: packet size(%d) exceeds limit(%d)", sz, c.MaxFrameSize())
+	}
+
+	if cap(c.rdbuf) < sz {
+		c.rdbuf = make([]byte, sz)
+	}
+	rdbuf := c.rdbuf[:sz]
+	if _, err = io.ReadFull(c.rd, rdbuf); err != nil {
+		return err
 	}
 
-	if err := proto.Unmarshal(rdbuf[:], p); err != nil {
+	if err := proto.Unmarshal(rdbuf, p); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (c *Codec) WritePack(p *proto_base.Pack) error {
+	if err := c.BufferPack(p); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// write pack into buffer, call Flush to send buffered packs
+func (c *Codec) BufferPack(p *proto_base.Pack) error {
 	if p == nil {
 		return nil
 	}
@@ -61,21 +269,37 @@ func (c *Codec) WritePack(p *proto_base.Pack) error {
 		return err
 	}
 
-	sz := uint16(len(data))
-	if sz > BUFLEN {
+	sz := len(data)
+	if sz > c.maxWriteFrameSize() {
 		return fmt.Errorf("WritePack: overflow packet size(%d)", sz)
 	}
 
-	if err = binary.Write(c.rwc, binary.BigEndian, sz); err != nil {
-		return err
+	var prefix [binary.MaxVarintLen64]byte
+	var n int
+	switch c.outFraming() {
+	case FramingUint16:
+		binary.BigEndian.PutUint16(prefix[:], uint16(sz))
+		n = 2
+	case FramingUint32:
+		binary.BigEndian.PutUint32(prefix[:], uint32(sz))
+		n = 4
+	default:
+		n = binary.PutUvarint(prefix[:], uint64(sz))
 	}
 
-	if _, err = c.rwc.Write(data); err != nil {
+	if _, err = c.wr.Write(prefix[:n]); err != nil {
+		return err
+	}
+	if _, err = c.wr.Write(data); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (c *Codec) Flush() error {
+	return c.wr.Flush()
+}
+
 func (c *Codec) Close() error {
 	return c.rwc.Close()
 }
@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/base"
+)
+
+func testPack(size int) *proto_base.Pack {
+	return &proto_base.Pack{
+		Session: proto.Int32(1),
+		Type:    proto.Int32(100),
+		Data:    bytes.Repeat([]byte{'x'}, size),
+	}
+}
+
+func TestCodecFraming(t *testing.T) {
+	for _, f := range []Framing{FramingUint16, FramingUint32, FramingVarint} {
+		c1, c2 := net.Pipe()
+		w, r := NewCodec(c1), NewCodec(c2)
+
+		size := 100
+		if f != FramingUint16 {
+			size = 200000
+		}
+		done := make(chan error, 1)
+		go func() {
+			if f != FramingUint16 {
+				if err := w.Negotiate(f); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- w.WritePack(testPack(size))
+		}()
+
+		var p proto_base.Pack
+		if err := r.ReadPack(&p); err != nil {
+			t.Fatalf("%s: read pack: %v", f, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%s: write pack: %v", f, err)
+		}
+		if r.Framing() != f || r.Negotiated() != (f != FramingUint16) {
+			t.Fatalf("%s: framing not negotiated: %s", f, r.Framing())
+		}
+		if len(p.GetData()) != size || p.GetType() != 100 {
+			t.Fatalf("%s: unexpected pack: type %d, data %d", f, p.GetType(), len(p.GetData()))
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestCodecMaxFrameSize(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	w := NewCodec(c1)
+	if err := w.WritePack(testPack(BUFLEN)); err == nil {
+		t.Fatal("legacy framing should reject oversized pack")
+	}
+
+	go func() {
+		w.Negotiate(FramingUint32)
+		w.WritePack(testPack(2048))
+	}()
+	r := NewCodec(c2)
+	r.SetMaxFrameSize(1024)
+	var p proto_base.Pack
+	if err := r.ReadPack(&p); err == nil {
+		t.Fatal("reader should reject pack over max frame size")
+	}
+}
@@ -4,12 +4,16 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/golang/protobuf/proto"
@@ -20,8 +24,15 @@ import (
 type ContextOwner interface {
 	getDescriptor(name string) *Descriptor
 	getService(int32) *service
+	handle(c *Context, s *service, argv, reply interface{}) *CallError
+	clientInterceptor() ClientInterceptor
 	onIoError(*Context, error)
 	onUnknownPack(*Context, *proto_base.Pack) bool
+	onClose(*Context)
+	acquireSlot(wait <-chan struct{}) bool
+	releaseSlot()
+	orderKey(*Descriptor, interface{}) (string, bool)
+	retryPolicy(*Descriptor) *RetryPolicy
 }
 
 type Call struct {
@@ -30,9 +41,30 @@ type Call struct {
 	Reply interface{}
 	Error *CallError
 	Done  chan *Call
+
+	Metadata      Metadata // sent with request, may be changed by ClientInterceptor
+	ReplyMetadata Metadata // received with response
+
+	ctx      context.Context
+	session  int32
+	fanout   bool          // sent by fan-out, never waits for write queue
+	exit     chan struct{} // closed when call is done, if context is cancelable
+	finishes []func(*Call)
+}
+
+// f is called when call is done, before call is sent to Done channel.
+// it should be registered before call is sent, e.g. in a ClientInterceptor
+func (call *Call) OnDone(f func(*Call)) {
+	call.finishes = append(call.finishes, f)
 }
 
 func (call *Call) done() {
+	if call.exit != nil {
+		close(call.exit)
+	}
+	for _, f := range call.finishes {
+		f(call)
+	}
 	select {
 	case call.Done <- call:
 	default:
@@ -42,7 +74,45 @@ func (call *Call) done() {
 	}
 }
 
-type Context struct {
+// pack types, type of request is service id
+const (
+	typeResponse int32 = 0
+	typeCancel   int32 = -1 // control frames have negative types
+	typeGoAway   int32 = -2 // peer is shutting down, no more requests
+	typeAuth     int32 = -3 // authentication handshake
+
+	// stream frames
+	typeStreamMsg      int32 = -4 // message from opener
+	typeStreamEnd      int32 = -5 // opener has no more messages
+	typeStreamAck      int32 = -6 // opener grants credits to acceptor
+	typeStreamReply    int32 = -7 // message from acceptor
+	typeStreamReplyAck int32 = -8 // acceptor grants credits to opener
+
+	typePing int32 = -9  // heartbeat
+	typePong int32 = -10 // answer of heartbeat
+
+	typeNegotiate int32 = -11 // framing preamble in write queue, written as preamble not as a pack
+)
+
+// max time SetFraming waits for the preamble of peer
+const negotiateTimeout = 10 * time.Second
+
+// reserved space for pack fields other than data in a chunk
+const chunkOverhead = 32
+
+const DefaultMaxMessageSize = 64 << 20
+
+// max size of all partial messages of a connection
+const DefaultMaxPendingSize = 128 << 20
+
+// partial data of a chunked pack
+type chunkKey struct {
+	response bool
+	session  int32
+}
+
+// state shared by all contexts of one connection
+type endpoint struct {
 	owner    ContextOwner
 	conn     net.Conn
 	codec    *Codec
@@ -50,17 +120,242 @@ type Context struct {
 	sessLock sync.Mutex
 	sessions map[int32]*Call
 
+	// chunks waiting for reassembly, only accessed by serve goroutine
+	chunks     map[chunkKey][]byte
+	chunkBytes int // size of all partial messages
+	maxMessage int
+	maxPending int
+
+	// cancel functions of running requests which have a reply
+	reqLock  sync.Mutex
+	requests map[int32]context.CancelFunc
+
+	// serial queues of ordered requests
+	orderLock sync.Mutex
+	orders    map[string]*serialQueue
+
+	// authentication
+	authenticator Authenticator
+	authSession   AuthSession // only accessed by serve goroutine
+	authServing   int32       // handshake id of authSession, only accessed by serve goroutine
+	principal     atomic.Value
+	authLock      sync.Mutex
+	authReply     chan *proto_base.Pack
+	authId        int32 // handshake id of Authenticate, accessed atomically
+
+	// streams opened by this side and by peer
+	streamLock   sync.Mutex
+	outStreams   map[int32]*Stream
+	inStreams    map[int32]*Stream
+	streamWindow int
+
+	// limit of running requests
+	slots           semaphore
+	pauseOnOverload bool
+	paused          chan pausedRequest // requests waiting for slots, closed when serve quits
+	pausedCount     int32              // requests in paused and being started
+	pauseOnce       sync.Once
+
+	// framing negotiation
+	preambleSent int32         // preamble is queued, accessed atomically
+	serving      int32         // serve goroutine is running, accessed atomically
+	peerFramed   chan struct{} // closed when preamble of peer is read
+
+	// packs waiting for writer goroutine
+	outq        chan *proto_base.Pack
+	queuePolicy QueuePolicy
+	writerOnce  sync.Once
+	quit        chan struct{}
+	writerDone  chan struct{}
+
+	// heartbeats and timeouts
+	activity    activity
+	monitorOnce sync.Once
+
+	// closed when connection is down
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeErr  error
+
+	id         uint64 // assigned by server
+	inflight   int32  // running requests
+	draining   int32  // local side is going away, reject new requests
+	peerLeaves int32  // peer is going away, don't send new requests
+
 	// err context
 	err *error
 }
 
+/*
+	Context implements context.Context
+	the context handed to a service is scoped to the request: it's done when
+	the caller's deadline passes, the caller cancels or the connection is down.
+	otherwise it's done when the connection is down.
+*/
+type Context struct {
+	*endpoint
+	ctx context.Context
+}
+
 func NewContext(owner ContextOwner, conn net.Conn) *Context {
-	return &Context{
+	ctx, cancel := context.WithCancel(context.Background())
+	ep := &endpoint{
 		owner:    owner,
 		conn:     conn,
 		codec:    NewCodec(conn),
 		sessions: make(map[int32]*Call),
+		chunks:   make(map[chunkKey][]byte),
+		requests: make(map[int32]context.CancelFunc),
+		orders:   make(map[string]*serialQueue),
+		outq:     make(chan *proto_base.Pack, DefaultWriteQueueSize),
+		quit:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+
+		writerDone: make(chan struct{}),
+		authReply:  make(chan *proto_base.Pack, 1),
+		peerFramed: make(chan struct{}),
+
+		maxMessage: DefaultMaxMessageSize,
+		maxPending: DefaultMaxPendingSize,
+
+		outStreams:   make(map[int32]*Stream),
+		inStreams:    make(map[int32]*Stream),
+		streamWindow: DefaultStreamWindow,
 	}
+	now := time.Now().UnixNano()
+	ep.activity.lastWrite, ep.activity.lastActive = now, now
+	c := &Context{endpoint: ep, ctx: ctx}
+	ep.codec.onPreamble = c.acceptFraming
+	return c
+}
+
+func (c *Context) Deadline() (time.Time, bool) {
+	return c.ctx.Deadline()
+}
+
+func (c *Context) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+func (c *Context) Err() error {
+	return c.ctx.Err()
+}
+
+func (c *Context) Value(key interface{}) interface{} {
+	return c.ctx.Value(key)
+}
+
+// context of a request received from peer
+func (c *Context) withRequest(pack *proto_base.Pack, hasReply bool) (*Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := pack.GetTimeout(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(c.endpoint.ctx, time.Duration(timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(c.endpoint.ctx)
+	}
+	ctx = context.WithValue(ctx, requestMetaKey{}, &requestMeta{in: decodeMetadata(pack.GetMeta())})
+
+	session := pack.GetSession()
+	if !hasReply || session == 0 {
+		return &Context{endpoint: c.endpoint, ctx: ctx}, cancel
+	}
+
+	c.reqLock.Lock()
+	c.requests[session] = cancel
+	c.reqLock.Unlock()
+	return &Context{endpoint: c.endpoint, ctx: ctx}, func() {
+		c.reqLock.Lock()
+		delete(c.requests, session)
+		c.reqLock.Unlock()
+		cancel()
+	}
+}
+
+// peer gave up the request
+func (c *Context) cancelRequest(session int32) {
+	c.reqLock.Lock()
+	cancel := c.requests[session]
+	c.reqLock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+/*
+	use framing f for frames sent to peer, peer must support negotiation.
+	the preamble is sent through write queue, peer answers with its own preamble
+	and uses same framing after it. SetFraming waits for the answer if the
+	context is being served, otherwise it returns once the preamble is queued
+*/
+func (c *Context) SetFraming(f Framing) error {
+	if f > FramingVarint {
+		return fmt.Errorf("SetFraming: unknown framing %s", f)
+	}
+	if !atomic.CompareAndSwapInt32(&c.preambleSent, 0, 1) {
+		return errors.New("SetFraming: framing is already negotiated")
+	}
+	if err := c.queuePreamble(f); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&c.serving) == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(negotiateTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.peerFramed:
+		return nil
+	case <-c.endpoint.ctx.Done():
+		return errContextClosed
+	case <-timer.C:
+		return errors.New("SetFraming: peer does not answer")
+	}
+}
+
+func (c *Context) queuePreamble(f Framing) error {
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(0)
+	pack.Type = proto.Int32(typeNegotiate)
+	pack.Data = []byte{byte(f)}
+	return c.enqueue(&pack, frameOther)
+}
+
+// preamble of peer is read, answer it if this side has not sent one
+func (c *Context) acceptFraming(f Framing) {
+	if atomic.CompareAndSwapInt32(&c.preambleSent, 0, 1) {
+		c.queuePreamble(f)
+	}
+	close(c.peerFramed)
+}
+
+// peer knows control frames
+func (c *Context) negotiated() bool {
+	return atomic.LoadInt32(&c.preambleSent) != 0 || c.codec.Negotiated()
+}
+
+// set max frame size this side accepts, should be called before SetFraming which tells peer
+func (c *Context) SetMaxFrameSize(n int) {
+	c.codec.SetMaxFrameSize(n)
+}
+
+// set max size of a reassembled message
+func (c *Context) SetMaxMessageSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxMessageSize
+	}
+	c.maxMessage = n
+}
+
+// set max size of all partial messages, connection is closed when it's exceeded
+func (c *Context) SetMaxPendingSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxPendingSize
+	}
+	c.maxPending = n
 }
 
 func (c *Context) nextSession() int32 {
@@ -84,22 +379,43 @@ func (c *Context) grabSession(session int32) *Call {
 }
 
 func (c *Context) closeAllSessions() {
-	c.sessLock.Lock()
-	defer c.sessLock.Unlock()
-
 	msg := "connection down"
-	if c.err != nil {
-		msg += ": " + (*c.err).Error()
+	// set by serve, which may still run when Close is called by others
+	if err := (*error)(atomic.LoadPointer((*unsafe.Pointer)((unsafe.Pointer)(&c.err)))); err != nil {
+		msg += ": " + (*err).Error()
 	}
 
+	c.sessLock.Lock()
+	calls := make([]*Call, 0, len(c.sessions))
 	for k, call := range c.sessions {
 		delete(c.sessions, k)
+		calls = append(calls, call)
+	}
+	c.sessLock.Unlock()
 
-		call.Error = NewCallError(0, msg)
+	// done out of lock, callbacks may make new calls
+	for _, call := range calls {
+		call.Error = NewCallError(ErrCodeUnavailable, msg)
 		call.done()
 	}
 }
 
+// milliseconds left before deadline of ctx, nil if it has no deadline.
+// it's clamped to fit in int32, about 24 days
+func packTimeout(ctx context.Context) *int32 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	timeout := time.Until(deadline) / time.Millisecond
+	if timeout < 1 {
+		timeout = 1
+	} else if timeout > math.MaxInt32 {
+		timeout = math.MaxInt32
+	}
+	return proto.Int32(int32(timeout))
+}
+
 func (c *Context) setError(err error) {
 	atomic.CompareAndSwapPointer((*unsafe.Pointer)((unsafe.Pointer)(&c.err)), nil, unsafe.Pointer(&err))
 }
@@ -107,11 +423,21 @@ func (c *Context) setError(err error) {
 // unblock call a service which has a reply
 // if method, argv and reply do not match, return return a error
 func (c *Context) Go(method string, argv interface{}, reply interface{}, done chan *Call) (*Call, error) {
+	return c.GoContext(context.Background(), method, argv, reply, done)
+}
+
+// same as Go, but the call is abandoned when ctx is done.
+// the call completes with a timeout or canceled CallError then, and a late response is dropped
+func (c *Context) GoContext(ctx context.Context, method string, argv interface{}, reply interface{}, done chan *Call) (*Call, error) {
 	dptor := c.owner.getDescriptor(method)
 	if dptor == nil {
 		return nil, fmt.Errorf("call unknown method:%s", method)
 	}
 
+	if dptor.IsStream() {
+		return nil, fmt.Errorf("canot call stream method %s, use OpenStream instead", method)
+	}
+
 	if !dptor.HasReply() {
 		return nil, fmt.Errorf("canot call method %s, use invoke instead", method)
 	}
@@ -120,12 +446,6 @@ func (c *Context) Go(method string, argv interface{}, reply interface{}, done ch
 		return nil, fmt.Errorf("call method %s with unmatch arg or reply", method)
 	}
 
-	var pack proto_base.Pack
-	session := c.nextSession()
-	pack.Session = proto.Int32(session)
-	pack.Type = proto.Int32(dptor.Id)
-	pack.Data, _ = proto.Marshal(argv.(proto.Message))
-
 	if done == nil {
 		done = make(chan *Call, 1)
 	} else {
@@ -139,16 +459,111 @@ func (c *Context) Go(method string, argv interface{}, reply interface{}, done ch
 		Argv:  argv,
 		Reply: reply,
 		Done:  done,
+		ctx:   ctx,
+
+		Metadata: OutgoingMetadata(ctx),
+	}
+
+	if err := ctx.Err(); err != nil {
+		call.Error = contextCallError(err)
+		call.done()
+		return call, nil
+	}
+
+	if atomic.LoadInt32(&c.peerLeaves) != 0 {
+		call.Error = NewCallError(ErrCodeUnavailable, "peer is going away")
+		call.done()
+		return call, nil
+	}
+
+	if err := c.intercept(call); err != nil {
+		if callError, ok := err.(*CallError); ok && call.session == 0 {
+			// rejected by interceptor before sent
+			call.Error = callError
+			call.done()
+			return call, nil
+		}
+		return nil, err
 	}
-	c.setSession(session, call)
-	c.writePack(&pack)
 	return call, nil
 }
 
+// run outgoing interceptors before call is sent
+func (c *Context) intercept(call *Call) error {
+	if interceptor := c.owner.clientInterceptor(); interceptor != nil {
+		return interceptor(c, call, sendCall)
+	}
+	return sendCall(c, call)
+}
+
+// the last Invoker of outgoing chain, write call to peer
+func sendCall(c *Context, call *Call) error {
+	dptor := call.Dptor
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(0)
+	pack.Type = proto.Int32(dptor.Id)
+	pack.Data, _ = proto.Marshal(call.Argv.(proto.Message))
+	pack.Meta = encodeMetadata(call.Metadata)
+
+	if !dptor.HasReply() {
+		if len(pack.Data) > c.chunkSize() {
+			// chunks are tied together by session
+			pack.Session = proto.Int32(c.nextSession())
+		}
+		if call.fanout {
+			return c.writePack(&pack, frameFanout)
+		}
+		return c.writePack(&pack, frameInvoke)
+	}
+
+	ctx := call.ctx
+	pack.Timeout = packTimeout(ctx)
+
+	session := c.nextSession()
+	pack.Session = proto.Int32(session)
+	call.session = session
+	if ctx.Done() != nil {
+		call.exit = make(chan struct{})
+	}
+	c.setSession(session, call)
+	if err := c.endpoint.ctx.Err(); err != nil {
+		// closed before session is set, closeAllSessions missed it
+		if c.grabSession(session) == call {
+			call.Error = NewCallError(ErrCodeUnavailable, "connection down")
+			call.done()
+		}
+		return nil
+	}
+	if err := c.writePack(&pack, frameCall); err != nil {
+		if c.grabSession(session) == call {
+			call.Error = writeCallError(err)
+			call.done()
+		}
+		return nil
+	}
+	if call.exit != nil {
+		go c.watchCall(ctx, call)
+	}
+	return nil
+}
+
+// abandon call when ctx is done before the response arrives
+func (c *Context) watchCall(ctx context.Context, call *Call) {
+	select {
+	case <-ctx.Done():
+		if c.grabSession(call.session) == call {
+			call.Error = contextCallError(ctx.Err())
+			call.done()
+			c.writeCancel(call.session)
+		}
+	case <-call.exit:
+	}
+}
+
 func (c *Context) MustGo(method string, argv interface{}, reply interface{}, done chan *Call) *Call {
 	call, err := c.Go(method, argv, reply, done)
 	if err != nil {
-		log.Panic("MustGo failed: method:%s, argv:%v", method, argv)
+		log.Panicf("MustGo failed: method:%s, argv:%v", method, argv)
 	}
 	return call
 }
@@ -156,7 +571,24 @@ func (c *Context) MustGo(method string, argv interface{}, reply interface{}, don
 // block call a service which has a reply
 // if method, argv and reply do not match, return return a error
 func (c *Context) Call(method string, argv interface{}, reply interface{}) (*CallError, error) {
-	call, err := c.Go(method, argv, reply, nil)
+	return c.CallContext(context.Background(), method, argv, reply)
+}
+
+// same as Call, but gives up when ctx is done.
+// failed call is retried if the method has a RetryPolicy
+func (c *Context) CallContext(ctx context.Context, method string, argv interface{}, reply interface{}) (*CallError, error) {
+	var policy *RetryPolicy
+	dptor := c.owner.getDescriptor(method)
+	if dptor != nil {
+		policy = c.owner.retryPolicy(dptor)
+	}
+	return retryCall(ctx, dptor, policy, func() (*CallError, error) {
+		return c.callOnce(ctx, method, argv, reply)
+	})
+}
+
+func (c *Context) callOnce(ctx context.Context, method string, argv interface{}, reply interface{}) (*CallError, error) {
+	call, err := c.GoContext(ctx, method, argv, reply, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -168,59 +600,183 @@ func (c *Context) Call(method string, argv interface{}, reply interface{}) (*Cal
 func (c *Context) MustCall(method string, argv interface{}, reply interface{}) *CallError {
 	callError, err := c.Call(method, argv, reply)
 	if err != nil {
-		log.Panic("MustCall failed: method:%s, argv:%v", method, argv)
+		log.Panicf("MustCall failed: method:%s, argv:%v", method, argv)
 	}
 	return callError
 }
 
 // invoke a service which has not a reply
 func (c *Context) Invoke(method string, argv interface{}) error {
-	dptor := c.owner.getDescriptor(method)
+	return c.InvokeContext(context.Background(), method, argv)
+}
+
+// same as Invoke, metadata attached to ctx is sent with the request
+func (c *Context) InvokeContext(ctx context.Context, method string, argv interface{}) error {
+	dptor, err := invokeDescriptor(c.owner, method, argv)
+	if err != nil {
+		return err
+	}
+	return c.invokeContext(ctx, dptor, argv)
+}
+
+// check method can be invoked with argv
+func invokeDescriptor(owner ContextOwner, method string, argv interface{}) (*Descriptor, error) {
+	dptor := owner.getDescriptor(method)
 	if dptor == nil {
-		return fmt.Errorf("invoke unknown method:%s", method)
+		return nil, fmt.Errorf("invoke unknown method:%s", method)
+	}
+
+	if dptor.IsStream() {
+		return nil, fmt.Errorf("canot invoke stream method %s, use OpenStream instead", method)
 	}
 
 	if dptor.HasReply() {
-		return fmt.Errorf("canot invoke method %s, use call instead", method)
+		return nil, fmt.Errorf("canot invoke method %s, use call instead", method)
 	}
 
 	if !dptor.MatchArgType(reflect.TypeOf(argv)) {
-		return fmt.Errorf("invoke method %s with unmatch argv", method)
+		return nil, fmt.Errorf("invoke method %s with unmatch argv", method)
 	}
+	return dptor, nil
+}
 
-	var pack proto_base.Pack
-	pack.Session = proto.Int32(0)
-	pack.Type = proto.Int32(dptor.Id)
-	pack.Data, _ = proto.Marshal(argv.(proto.Message))
+func (c *Context) invokeContext(ctx context.Context, dptor *Descriptor, argv interface{}) error {
+	return c.sendInvoke(ctx, dptor, argv, false)
+}
 
-	c.writePack(&pack)
-	return nil
+// invoke of fan-out fails at once if write queue is full
+func (c *Context) fanout(dptor *Descriptor, argv interface{}) error {
+	return c.sendInvoke(context.Background(), dptor, argv, true)
+}
+
+func (c *Context) sendInvoke(ctx context.Context, dptor *Descriptor, argv interface{}, fanout bool) error {
+	if atomic.LoadInt32(&c.peerLeaves) != 0 {
+		return NewCallError(ErrCodeUnavailable, "peer is going away")
+	}
+
+	call := &Call{
+		Dptor:  dptor,
+		Argv:   argv,
+		ctx:    ctx,
+		fanout: fanout,
+
+		Metadata: OutgoingMetadata(ctx),
+	}
+	return c.intercept(call)
 }
 
 // same as invoke except it panics if any error happen
 func (c *Context) MustInvoke(method string, argv interface{}) {
 	err := c.Invoke(method, argv)
 	if err != nil {
-		log.Panic("MustInvoke failed: method:%s, argv:%v", method, argv)
+		log.Panicf("MustInvoke failed: method:%s, argv:%v", method, argv)
+	}
+}
+
+// tell peer to stop the request, only if peer knows control frames
+func (c *Context) writeCancel(session int32) {
+	if !c.negotiated() {
+		return
 	}
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(session)
+	pack.Type = proto.Int32(typeCancel)
+	c.writePack(&pack, frameOther)
+}
+
+// frames fit in limits of both sides
+func (c *Context) chunkSize() int {
+	return c.codec.maxWriteFrameSize() - chunkOverhead
 }
 
-func (c *Context) writePack(pack *proto_base.Pack) {
+// split pack whose data exceeds frame limit into several frames, and queue them
+func (c *Context) writePack(pack *proto_base.Pack, kind frameKind) error {
 	log.Printf("write pack:%d %d %d", pack.GetSession(), pack.GetType(), len(pack.GetData()))
-	err := c.codec.WritePack(pack)
-	if err != nil {
-		c.setError(err)
-		c.Close()
+	data := pack.Data
+	size := c.chunkSize()
+	if len(pack.Meta) > 0 {
+		// metadata is carried by the last chunk
+		size -= proto.Size(&proto_base.Pack{Meta: pack.Meta})
+		if size <= 0 {
+			return fmt.Errorf("write pack: metadata exceeds frame limit")
+		}
+	}
+	if kind == frameFanout && len(data) > size {
+		// following chunks wait, so queue them only if there is room for all
+		n := (len(data) + size - 1) / size
+		if cap(c.outq)-len(c.outq) < n {
+			return NewCallError(ErrCodeQueueFull, "write queue is full")
+		}
+	}
+	for len(data) > size {
+		chunk := &proto_base.Pack{
+			Session: pack.Session,
+			Type:    pack.Type,
+			Data:    data[:size],
+			More:    proto.Bool(true),
+		}
+		if err := c.enqueue(chunk, kind); err == errInvokeDropped {
+			// only the first chunk can be dropped, nothing of the invoke is sent
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// following chunks must not be dropped
+		kind = frameOther
+		data = data[size:]
+	}
+	pack.Data = data
+	if err := c.enqueue(pack, kind); err != errInvokeDropped {
+		return err
 	}
+	return nil
+}
+
+// collect chunks, return false if pack is not complete yet
+func (c *Context) reassemble(pack *proto_base.Pack) (bool, error) {
+	typ := pack.GetType()
+	key := chunkKey{response: typ == typeResponse || typ == typeStreamReply, session: pack.GetSession()}
+	buf, ok := c.chunks[key]
+	if !ok && !pack.GetMore() {
+		return true, nil
+	}
+
+	if len(buf)+len(pack.Data) > c.maxMessage {
+		delete(c.chunks, key)
+		c.chunkBytes -= len(buf)
+		return false, fmt.Errorf("session %d: message exceeds limit(%d)", key.session, c.maxMessage)
+	}
+	if pack.GetMore() && c.chunkBytes+len(pack.Data) > c.maxPending {
+		return false, fmt.Errorf("session %d: partial messages exceed limit(%d)", key.session, c.maxPending)
+	}
+	buf = append(buf, pack.Data...)
+	if pack.GetMore() {
+		c.chunks[key] = buf
+		c.chunkBytes += len(pack.Data)
+		return false, nil
+	}
+	delete(c.chunks, key)
+	c.chunkBytes -= len(buf) - len(pack.Data)
+	pack.Data = buf
+	return true, nil
 }
 
 func (c *Context) dispatchResponse(pack *proto_base.Pack) bool {
 	log.Printf("dispatch response:%d", pack.GetSession())
 	call := c.grabSession(pack.GetSession())
 	if call == nil {
+		if c.endStream(pack) {
+			return true
+		}
+		if session := pack.GetSession(); session > 0 && session <= atomic.LoadInt32(&c.session) {
+			// response of an abandoned call
+			log.Printf("drop late response:%d", session)
+			return true
+		}
 		return c.owner.onUnknownPack(c, pack)
 	}
 
+	call.ReplyMetadata = decodeMetadata(pack.GetMeta())
 	packError := pack.GetError()
 	if packError.GetFailed() {
 		call.Error = NewRpcCallError(packError.GetCode(), packError.GetError())
@@ -243,55 +799,187 @@ func (c *Context) dispatchRequest(pack *proto_base.Pack) bool {
 		return c.owner.onUnknownPack(c, pack)
 	}
 
-	argv := reflect.New(s.dptor.ArgType.Elem())
-	if err := proto.Unmarshal(pack.GetData(), argv.Interface().(proto.Message)); err != nil {
+	if err := c.authorize(s.dptor); err != nil {
+		c.rejectRequest(s, pack, err)
+		return true
+	}
+
+	if s.dptor.IsStream() {
+		return c.acceptStream(s, pack)
+	}
+
+	argv, reply := s.newArgs()
+	if err := proto.Unmarshal(pack.GetData(), argv.(proto.Message)); err != nil {
 		return c.owner.onUnknownPack(c, pack)
 	}
 
-	var replyv reflect.Value
-	if s.hasReply() {
-		replyv = reflect.New(s.dptor.ReplyType.Elem())
-	}
-
-	go func() {
-		if s.hasReply() {
-			callError := s.call(c, argv, replyv)
-			pack.Type = proto.Int32(0)
-			pack.Data = nil
-			if callError != nil {
-				pack.GetError().Failed = proto.Bool(false)
-				pack.GetError().Code = proto.Int32(callError.Code)
-				pack.GetError().Error = proto.String(callError.Msg)
-			} else {
-				pack.Data, _ = proto.Marshal(replyv.Interface().(proto.Message))
+	// counted before draining is checked, so Shutdown never misses it.
+	// waiting requests count too
+	atomic.AddInt32(&c.inflight, 1)
+	if atomic.LoadInt32(&c.draining) != 0 {
+		atomic.AddInt32(&c.inflight, -1)
+		c.rejectRequest(s, pack, NewCallError(ErrCodeUnavailable, "server is going away"))
+		return true
+	}
+
+	context, cancel := c.withRequest(pack, s.hasReply())
+	task := func() {
+		callError := c.owner.handle(context, s, argv, reply)
+		c.giveSlot()
+		// response is queued before the request is done, so Close flushes it
+		if s.hasReply() && context.Err() == nil {
+			var msg proto.Message
+			if callError == nil {
+				msg = reply.(proto.Message)
 			}
-			c.writePack(pack)
+			c.writeResponse(pack.GetSession(), msg, callError, context.replyMetadata())
+		}
+		cancel()
+		atomic.AddInt32(&c.inflight, -1)
+	}
+	start := func() {
+		if key, ok := c.owner.orderKey(s.dptor, argv); ok {
+			c.runSerial(key, task)
 		} else {
-			s.invoke(c, argv)
+			go task()
 		}
-	}()
+	}
+	drop := func() {
+		cancel()
+		atomic.AddInt32(&c.inflight, -1)
+	}
+	reject := func() {
+		c.rejectRequest(s, pack, NewCallError(ErrCodeOverload, "too many requests"))
+		drop()
+	}
+	c.schedule(context, start, reject, drop)
 	log.Printf("request done:%d %d %d", pack.GetSession(), pack.GetType(), len(pack.GetData()))
 	return true
 }
 
+// reply callError if request has a reply, otherwise drop it
+func (c *Context) rejectRequest(s *service, pack *proto_base.Pack, callError *CallError) {
+	if s.hasReply() {
+		c.writeResponse(pack.GetSession(), nil, callError, nil)
+	} else {
+		log.Printf("drop request %s: %v", s.dptor.NormalName, callError)
+	}
+}
+
+func (c *Context) writeResponse(session int32, reply proto.Message, callError *CallError, md Metadata) {
+	var rsp proto_base.Pack
+	rsp.Session = proto.Int32(session)
+	rsp.Type = proto.Int32(typeResponse)
+	rsp.Meta = encodeMetadata(md)
+	if callError != nil {
+		rsp.Error = &proto_base.Error{
+			Failed: proto.Bool(true),
+			Code:   proto.Int32(callError.Code),
+			Error:  proto.String(callError.Msg),
+		}
+	} else if reply != nil {
+		rsp.Data, _ = proto.Marshal(reply)
+	}
+	c.writePack(&rsp, frameOther)
+}
+
+// connection id, unique in a server. contexts not accepted by a server have id 0
+func (c *Context) Id() uint64 {
+	return c.id
+}
+
+func (c *Context) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// number of running requests
+func (c *Context) InFlight() int {
+	return int(atomic.LoadInt32(&c.inflight))
+}
+
+// stop accepting new requests and tell peer.
+// it never blocks, go-away is not sent if write queue is full
+func (c *Context) goAway() {
+	if !atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		return
+	}
+	if !c.negotiated() {
+		return
+	}
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(0)
+	pack.Type = proto.Int32(typeGoAway)
+	if !c.tryEnqueue(&pack) {
+		log.Printf("write queue full, drop go-away")
+	}
+}
+
+func (c *Context) dispatchControl(pack *proto_base.Pack) bool {
+	switch pack.GetType() {
+	case typeCancel:
+		c.cancelRequest(pack.GetSession())
+		return true
+	case typeGoAway:
+		atomic.StoreInt32(&c.peerLeaves, 1)
+		return true
+	case typeAuth:
+		if c.authenticator != nil {
+			return c.serveAuth(pack)
+		}
+		return c.dispatchAuthReply(pack)
+	case typeStreamMsg, typeStreamEnd, typeStreamAck, typeStreamReply, typeStreamReplyAck:
+		return c.dispatchStream(pack)
+	case typePing:
+		c.writeHeartbeat(typePong)
+		return true
+	case typePong:
+		return true
+	}
+	return c.owner.onUnknownPack(c, pack)
+}
+
 func (c *Context) Close() error {
-	c.closeAllSessions()
-	return c.codec.Close()
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.stopWriter()
+		c.closeAllSessions()
+		c.closeAllStreams()
+		c.closeErr = c.codec.Close()
+		c.owner.onClose(c)
+	})
+	return c.closeErr
 }
 
 func (c *Context) serve() {
-	var err error
-	for {
+	atomic.StoreInt32(&c.serving, 1)
+	err := c.handshakeTLS()
+	if err != nil {
+		c.owner.onIoError(c, err)
+	}
+	for err == nil {
 		var pack proto_base.Pack
+		c.setReadDeadline()
 		if err = c.codec.ReadPack(&pack); err != nil {
 			c.owner.onIoError(c, err)
 			break
 		}
+		c.touch(&pack, false)
+
+		complete, rerr := c.reassemble(&pack)
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		if !complete {
+			continue
+		}
 
 		typ := pack.GetType()
 		var keepServing bool
-		if typ == 0 { // response
+		if typ == typeResponse {
 			keepServing = c.dispatchResponse(&pack)
+		} else if typ < 0 {
+			keepServing = c.dispatchControl(&pack)
 		} else {
 			keepServing = c.dispatchRequest(&pack)
 		}
@@ -302,4 +990,8 @@ func (c *Context) serve() {
 
 	c.setError(err)
 	c.Close()
+	if c.paused != nil {
+		// no more requests, waiting ones are dropped
+		close(c.paused)
+	}
 }
@@ -1,12 +1,27 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 )
 
+// reserved error codes, application codes should not be negative
+const (
+	ErrCodeCanceled         int32 = -1 // caller canceled the call
+	ErrCodeDeadlineExceeded int32 = -2 // call timeout
+	ErrCodeInternal         int32 = -3 // service panics
+	ErrCodeUnavailable      int32 = -4 // peer is going away or not connected
+	ErrCodeQueueFull        int32 = -5 // write queue of connection is full
+	ErrCodeOverload         int32 = -6 // too many running requests
+	ErrCodeUnauthenticated  int32 = -7 // peer has not authenticated
+	ErrCodePermissionDenied int32 = -8 // principal has no required role
+	ErrCodeCircuitOpen      int32 = -9 // circuit breaker rejects calls to failing peer
+)
+
 type CallError struct {
 	Code     int32
 	Msg      string
@@ -42,6 +57,10 @@ func (e *CallError) String() string {
 	return fmt.Sprintf("%s error: code:%d, msg:%s", tag, e.Code, e.Msg)
 }
 
+func (e *CallError) Error() string {
+	return e.String()
+}
+
 func (e *CallError) IsRpcError() bool {
 	if e == nil {
 		return false
@@ -49,22 +68,94 @@ func (e *CallError) IsRpcError() bool {
 	return e.RpcError
 }
 
+func (e *CallError) IsTimeout() bool {
+	return e != nil && e.Code == ErrCodeDeadlineExceeded
+}
+
+func (e *CallError) IsCanceled() bool {
+	return e != nil && e.Code == ErrCodeCanceled
+}
+
+// convert error of writing a call to CallError
+func writeCallError(err error) *CallError {
+	if callError, ok := err.(*CallError); ok {
+		return callError
+	}
+	return NewCallError(ErrCodeUnavailable, err.Error())
+}
+
+// convert error of context.Context to CallError
+func contextCallError(err error) *CallError {
+	if err == context.DeadlineExceeded {
+		return NewCallError(ErrCodeDeadlineExceeded, err.Error())
+	}
+	return NewCallError(ErrCodeCanceled, err.Error())
+}
+
+// which side sends a stream of messages
+type StreamKind int32
+
+const (
+	NoStream     StreamKind = iota
+	ServerStream            // client sends one message, server sends a stream
+	ClientStream            // client sends a stream, server sends one message
+	BidiStream              // both sides send streams
+)
+
+func (k StreamKind) String() string {
+	switch k {
+	case NoStream:
+		return "none"
+	case ServerStream:
+		return "server"
+	case ClientStream:
+		return "client"
+	case BidiStream:
+		return "bidi"
+	}
+	return fmt.Sprintf("StreamKind(%d)", int32(k))
+}
+
 type Descriptor struct {
 	Id         int32
 	NormalName string
 	MethodName string
 	ArgType    reflect.Type
 	ReplyType  reflect.Type
+	Public     bool     // callable before authentication
+	Roles      []string // principal should have one of roles, empty means any
+	Stream     StreamKind
+	Idempotent bool // can be retried safely, DefaultRetryPolicy applies
+
+	// generated dispatch without reflection, reflection is used if nil.
+	// NewArgs allocates argv and reply (nil if method has not a reply),
+	// Handler calls the method of receiver, argv is the *Stream of stream method
+	NewArgs func() (argv, reply interface{})
+	Handler func(rcvr interface{}, c *Context, argv, reply interface{}) *CallError
 }
 
 var typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
 var typeOfContext = reflect.TypeOf(&Context{})
 var typeOfError = reflect.TypeOf(&CallError{})
+var typeOfStream = reflect.TypeOf(&Stream{})
+
+// module name in protolist, e.g. "test" of "test.echo"
+func (d *Descriptor) Module() string {
+	if i := strings.Index(d.NormalName, "."); i >= 0 {
+		return d.NormalName[:i]
+	}
+	return d.NormalName
+}
 
 func (d *Descriptor) HasReply() bool {
 	return d.ReplyType != nil
 }
 
+// messages of streaming method are sent by Stream, ArgType from client and ReplyType from server
+func (d *Descriptor) IsStream() bool {
+	return d.Stream != NoStream
+}
+
 func (d *Descriptor) MatchArgType(typ reflect.Type) bool {
 	if typ.Kind() != reflect.Ptr || !typ.Implements(typeOfProtoMessage) || typ != d.ArgType {
 		return false
@@ -85,6 +176,9 @@ func (d *Descriptor) MatchReplyType(typ reflect.Type) bool {
 */
 func (d *Descriptor) MatchMethod(method reflect.Method) error {
 	mtyp := method.Type
+	if d.IsStream() {
+		return d.matchStreamMethod(mtyp)
+	}
 
 	// defautl args: rcvr, context, req
 	numIn := 3
@@ -128,3 +222,33 @@ func (d *Descriptor) MatchMethod(method reflect.Method) error {
 	}
 	return nil
 }
+
+/*
+	流式接口有两个参数，类型为*Context和*Stream，有一个error类型的返回值
+*/
+func (d *Descriptor) matchStreamMethod(mtyp reflect.Type) error {
+	if d.ReplyType == nil {
+		return fmt.Errorf("stream method %s should have a reply type", d.MethodName)
+	}
+
+	if mtyp.NumIn() != 3 {
+		return fmt.Errorf("method %s should have %d arguments", d.MethodName, 3)
+	}
+
+	if mtyp.NumOut() != 1 {
+		return fmt.Errorf("method %s should have %d return values", d.MethodName, 1)
+	}
+
+	if contextType := mtyp.In(1); contextType != typeOfContext {
+		return fmt.Errorf("method %s arg%d should be %s", d.MethodName, 1, typeOfContext.String())
+	}
+
+	if streamType := mtyp.In(2); streamType != typeOfStream {
+		return fmt.Errorf("method %s arg%d should be %s", d.MethodName, 2, typeOfStream.String())
+	}
+
+	if returnType := mtyp.Out(0); returnType != typeOfError {
+		return fmt.Errorf("method %s returns %s not %s", d.MethodName, returnType.String(), typeOfError.String())
+	}
+	return nil
+}
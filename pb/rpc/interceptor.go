@@ -0,0 +1,55 @@
+package rpc
+
+// serve a request, reply is nil if method has not a reply
+type Handler func(c *Context, argv, reply interface{}) *CallError
+
+/*
+	ServerInterceptor wraps the service of an incoming request
+	call handler to continue, or return a CallError to reject the request.
+	the returned CallError is ignored if method has not a reply
+*/
+type ServerInterceptor func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError
+
+// send call to peer, call.Reply is nil if method has not a reply
+type Invoker func(c *Context, call *Call) error
+
+/*
+	ClientInterceptor wraps an outgoing Go or Invoke
+	call invoker to continue. returning a *CallError fails the call with it,
+	returning other errors is reported by Go or Invoke.
+	use call.OnDone to observe the result
+*/
+type ClientInterceptor func(c *Context, call *Call, invoker Invoker) error
+
+// first interceptor is the outermost
+func chainServerInterceptors(interceptors []ServerInterceptor) ServerInterceptor {
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, h := interceptors[i], next
+			next = func(c *Context, argv, reply interface{}) *CallError {
+				return interceptor(c, dptor, argv, reply, h)
+			}
+		}
+		return next(c, argv, reply)
+	}
+}
+
+func chainClientInterceptors(interceptors []ClientInterceptor) ClientInterceptor {
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return func(c *Context, call *Call, invoker Invoker) error {
+		next := invoker
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inv := interceptors[i], next
+			next = func(c *Context, call *Call) error {
+				return interceptor(c, call, inv)
+			}
+		}
+		return next(c, call)
+	}
+}
@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/base"
+)
+
+/*
+	heartbeats and idle connections
+	keepalive: ping peer when nothing is written for a while, peer answers a pong.
+	read timeout: connection is closed when nothing is received for a while,
+	  together with keepalive of peer it detects dead peers.
+	write timeout: connection is closed when a write blocks too long.
+	idle timeout: connection is closed when no request or response is exchanged
+	  and no request is running, heartbeats don't count.
+	zero duration disables the feature
+*/
+
+var errIdleTimeout = errors.New("idle timeout")
+
+type activity struct {
+	keepalive        int64 // durations, accessed atomically
+	readTimeout      int64
+	writeTimeout     int64
+	idleTimeout      int64
+	handshakeTimeout int64
+
+	lastWrite  int64 // unix nano
+	lastActive int64
+}
+
+func durationOf(p *int64) time.Duration {
+	return time.Duration(atomic.LoadInt64(p))
+}
+
+// ping peer when nothing is written in interval, peer must support negotiation
+func (c *Context) SetKeepalive(interval time.Duration) {
+	atomic.StoreInt64(&c.activity.keepalive, int64(interval))
+	c.startMonitor()
+}
+
+func (c *Context) SetReadTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.activity.readTimeout, int64(d))
+}
+
+func (c *Context) SetWriteTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.activity.writeTimeout, int64(d))
+}
+
+// close connection when no request or response is exchanged in d
+func (c *Context) SetIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.activity.idleTimeout, int64(d))
+	c.startMonitor()
+}
+
+// record a frame is read or written
+func (c *Context) touch(pack *proto_base.Pack, write bool) {
+	now := time.Now().UnixNano()
+	if write {
+		atomic.StoreInt64(&c.activity.lastWrite, now)
+	}
+	if typ := pack.GetType(); typ != typePing && typ != typePong && typ != typeNegotiate {
+		atomic.StoreInt64(&c.activity.lastActive, now)
+	}
+}
+
+func (c *Context) setReadDeadline() {
+	if d := durationOf(&c.activity.readTimeout); d > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(d))
+	}
+}
+
+// deadline of close flushing is not extended
+func (c *Context) setWriteDeadline() {
+	if d := durationOf(&c.activity.writeTimeout); d > 0 && !isClosed(c.quit) {
+		c.conn.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+func (c *Context) startMonitor() {
+	c.monitorOnce.Do(func() {
+		go c.monitor()
+	})
+}
+
+// check period of monitor, half of the shortest interval
+func (c *Context) monitorPeriod() time.Duration {
+	period := time.Duration(0)
+	for _, d := range []time.Duration{durationOf(&c.activity.keepalive), durationOf(&c.activity.idleTimeout)} {
+		if d > 0 && (period == 0 || d < period) {
+			period = d
+		}
+	}
+	if period == 0 {
+		return time.Second
+	}
+	if period /= 2; period < time.Millisecond {
+		period = time.Millisecond
+	}
+	return period
+}
+
+func (c *Context) monitor() {
+	timer := time.NewTimer(c.monitorPeriod())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.endpoint.ctx.Done():
+			return
+		}
+
+		now := time.Now().UnixNano()
+		idle := now - atomic.LoadInt64(&c.activity.lastActive)
+		if d := durationOf(&c.activity.idleTimeout); d > 0 && idle >= int64(d) && c.InFlight() == 0 {
+			log.Printf("context %d: idle timeout", c.id)
+			c.setError(errIdleTimeout)
+			c.Close()
+			return
+		}
+		if d := durationOf(&c.activity.keepalive); d > 0 && now-atomic.LoadInt64(&c.activity.lastWrite) >= int64(d) {
+			c.writeHeartbeat(typePing)
+		}
+		timer.Reset(c.monitorPeriod())
+	}
+}
+
+// heartbeats are skipped if the write queue is full, connection is busy anyway
+func (c *Context) writeHeartbeat(typ int32) {
+	if !c.negotiated() {
+		return
+	}
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(0)
+	pack.Type = proto.Int32(typ)
+	c.tryEnqueue(&pack)
+}
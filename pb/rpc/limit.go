@@ -0,0 +1,144 @@
+package rpc
+
+import (
+	"sync/atomic"
+)
+
+// max requests waiting for slots of a connection in pause mode, more are rejected
+const maxPausedRequests = 1024
+
+// a counting semaphore, nil means unlimited
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// wait until wait is closed if it's not nil, otherwise fail at once
+func (s semaphore) acquire(wait <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+	if wait != nil {
+		select {
+		case s <- struct{}{}:
+			return true
+		case <-wait:
+			return false
+		}
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// request waiting for a slot
+type pausedRequest struct {
+	ctx   *Context
+	start func()
+	drop  func() // request is canceled or connection is down
+}
+
+/*
+	limit running requests of this context, n <= 0 means unlimited
+	if pause is true, requests wait in arrival order when the limit is hit,
+	otherwise the request is rejected with an overload CallError.
+	reading from connection goes on while requests wait, so responses and
+	control frames, e.g. cancel of a running request, are still handled.
+	streams hold a slot as long as they are open, they are rejected in both modes.
+	should be called before the context is served
+*/
+func (c *Context) SetMaxInFlight(n int, pause bool) {
+	c.slots = newSemaphore(n)
+	c.pauseOnOverload = pause
+	if pause {
+		c.paused = make(chan pausedRequest, maxPausedRequests)
+	}
+}
+
+// take a slot of context and owner for a request, giveSlot returns it.
+// wait for slots until wait is closed if it's not nil
+func (c *Context) takeSlot(wait <-chan struct{}) bool {
+	if !c.slots.acquire(wait) {
+		return false
+	}
+	if !c.owner.acquireSlot(wait) {
+		c.slots.release()
+		return false
+	}
+	return true
+}
+
+/*
+	start request if a slot is free, otherwise it waits in pause mode or is rejected.
+	it's called by serve goroutine, requests wait in a queue so reading goes on
+*/
+func (c *Context) schedule(ctx *Context, start func(), reject func(), drop func()) {
+	if atomic.LoadInt32(&c.pausedCount) == 0 && c.takeSlot(nil) {
+		start()
+		return
+	}
+	if !c.pauseOnOverload {
+		reject()
+		return
+	}
+
+	c.pauseOnce.Do(func() {
+		go c.runPaused()
+	})
+	atomic.AddInt32(&c.pausedCount, 1)
+	select {
+	case c.paused <- pausedRequest{ctx: ctx, start: start, drop: drop}:
+	default:
+		atomic.AddInt32(&c.pausedCount, -1)
+		reject()
+	}
+}
+
+// start paused requests one by one when slots are free, quit after serve closes the queue
+func (c *Context) runPaused() {
+	for req := range c.paused {
+		if req.ctx.Err() == nil && c.takeSlot(c.endpoint.ctx.Done()) {
+			req.start()
+		} else {
+			req.drop()
+		}
+		atomic.AddInt32(&c.pausedCount, -1)
+	}
+}
+
+func (c *Context) giveSlot() {
+	c.owner.releaseSlot()
+	c.slots.release()
+}
+
+// Rpc has no global limit
+func (r *Rpc) acquireSlot(wait <-chan struct{}) bool {
+	return true
+}
+
+func (r *Rpc) releaseSlot() {
+}
+
+func (server *Server) acquireSlot(wait <-chan struct{}) bool {
+	server.slotsOnce.Do(func() {
+		server.slots = newSemaphore(server.MaxInFlight)
+	})
+	return server.slots.acquire(wait)
+}
+
+func (server *Server) releaseSlot() {
+	server.slots.release()
+}
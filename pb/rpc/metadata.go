@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/base"
+)
+
+/*
+	metadata of requests and responses, e.g. trace id, locale, client version
+	outgoing metadata is attached to context.Context by WithMetadata,
+	and is sent by GoContext, CallContext and InvokeContext.
+	peers which don't know metadata just ignore it
+*/
+type Metadata map[string]string
+
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	m := make(Metadata, len(md))
+	for k, v := range md {
+		m[k] = v
+	}
+	return m
+}
+
+type outgoingKey struct{}
+
+// returns a copy of ctx which carries md, merged with metadata already in ctx
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := OutgoingMetadata(ctx).Copy()
+	if merged == nil {
+		merged = make(Metadata, len(md))
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, outgoingKey{}, merged)
+}
+
+// metadata to be sent with calls made with ctx
+func OutgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingKey{}).(Metadata)
+	return md
+}
+
+// metadata of a request being handled
+type requestMeta struct {
+	in Metadata
+
+	sync.Mutex
+	out Metadata
+}
+
+type requestMetaKey struct{}
+
+func (c *Context) requestMeta() *requestMeta {
+	rm, _ := c.ctx.Value(requestMetaKey{}).(*requestMeta)
+	return rm
+}
+
+// metadata sent by the caller of current request
+func (c *Context) Metadata() Metadata {
+	if rm := c.requestMeta(); rm != nil {
+		return rm.in
+	}
+	return nil
+}
+
+// add metadata to the response of current request.
+// it takes effect only for methods which have a reply, before the handler returns
+func (c *Context) SetReplyMetadata(key, value string) {
+	rm := c.requestMeta()
+	if rm == nil {
+		return
+	}
+	rm.Lock()
+	if rm.out == nil {
+		rm.out = make(Metadata)
+	}
+	rm.out[key] = value
+	rm.Unlock()
+}
+
+func (c *Context) replyMetadata() Metadata {
+	rm := c.requestMeta()
+	if rm == nil {
+		return nil
+	}
+	rm.Lock()
+	defer rm.Unlock()
+	return rm.out
+}
+
+// keys are sorted, so same metadata is encoded to same bytes
+func encodeMetadata(md Metadata) []*proto_base.Header {
+	if len(md) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	headers := make([]*proto_base.Header, len(keys))
+	for i, k := range keys {
+		headers[i] = &proto_base.Header{Key: proto.String(k), Value: proto.String(md[k])}
+	}
+	return headers
+}
+
+func decodeMetadata(headers []*proto_base.Header) Metadata {
+	if len(headers) == 0 {
+		return nil
+	}
+	md := make(Metadata, len(headers))
+	for _, h := range headers {
+		md[h.GetKey()] = h.GetValue()
+	}
+	return md
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"fmt"
+)
+
+// requests in the same order scope of a connection run one by one in arrival order
+type ordering struct {
+	scope string
+	key   func(argv interface{}) string
+}
+
+// tasks run serially in a goroutine which exits when queue is empty
+type serialQueue struct {
+	tasks []func()
+}
+
+/*
+	requests of method (e.g. "test.strobe") or all methods of module (e.g. "test")
+	run one by one per connection, in arrival order
+*/
+func (r *Rpc) SetSerial(name string) error {
+	return r.setOrdering(name, nil)
+}
+
+/*
+	same as SetSerial, but only requests with the same key are serialized.
+	key is extracted from the request argument
+*/
+func (r *Rpc) SetSerialByKey(name string, key func(argv interface{}) string) error {
+	if key == nil {
+		return fmt.Errorf("SetSerialByKey %s: key function is nil", name)
+	}
+	return r.setOrdering(name, key)
+}
+
+func (r *Rpc) setOrdering(name string, key func(argv interface{}) string) error {
+	if r.getDescriptor(name) == nil && !r.bridge.hasModule(name) {
+		return fmt.Errorf("unknown method or module:%s", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.orderings == nil {
+		r.orderings = make(map[string]*ordering)
+	}
+	r.orderings[name] = &ordering{scope: name, key: key}
+	return nil
+}
+
+// method setting takes precedence over module setting
+func (r *Rpc) orderKey(dptor *Descriptor, argv interface{}) (string, bool) {
+	r.mu.RLock()
+	o := r.orderings[dptor.NormalName]
+	if o == nil {
+		o = r.orderings[dptor.Module()]
+	}
+	r.mu.RUnlock()
+
+	if o == nil {
+		return "", false
+	}
+	if o.key == nil {
+		return o.scope, true
+	}
+	// names have no NUL, so keys never collide with a method scope
+	return o.scope + "\x00" + o.key(argv), true
+}
+
+// run task after earlier tasks of the same key
+func (c *Context) runSerial(key string, task func()) {
+	c.orderLock.Lock()
+	defer c.orderLock.Unlock()
+	if q, ok := c.orders[key]; ok {
+		q.tasks = append(q.tasks, task)
+		return
+	}
+	q := &serialQueue{tasks: []func(){task}}
+	c.orders[key] = q
+	go c.drainSerial(key, q)
+}
+
+func (c *Context) drainSerial(key string, q *serialQueue) {
+	for {
+		c.orderLock.Lock()
+		if len(q.tasks) == 0 {
+			delete(c.orders, key)
+			c.orderLock.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		c.orderLock.Unlock()
+
+		task()
+	}
+}
@@ -0,0 +1,450 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+/*
+	client of several servers
+	every backend is a ReconnectClient, calls are balanced among healthy backends.
+	a backend is ejected after MaxFailures consecutive failures, or when health check
+	fails, and is added back when health check passes
+*/
+type Backend struct {
+	*ReconnectClient
+	Address string
+
+	pending  int32 // running calls
+	failures int32 // consecutive failures
+	ejected  int32
+}
+
+func (b *Backend) Pending() int {
+	return int(atomic.LoadInt32(&b.pending))
+}
+
+// connected and not ejected
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.ejected) == 0 && b.State() == StateConnected
+}
+
+func (b *Backend) eject() {
+	if atomic.CompareAndSwapInt32(&b.ejected, 0, 1) {
+		log.Printf("eject backend %s", b.Address)
+	}
+}
+
+func (b *Backend) restore() {
+	atomic.StoreInt32(&b.failures, 0)
+	if atomic.CompareAndSwapInt32(&b.ejected, 1, 0) {
+		log.Printf("restore backend %s", b.Address)
+	}
+}
+
+// choose a backend for a request, backends are healthy ones and not empty
+type Balancer interface {
+	Pick(backends []*Backend, method string, argv interface{}) *Backend
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func RoundRobin() Balancer {
+	return new(roundRobin)
+}
+
+func (r *roundRobin) Pick(backends []*Backend, method string, argv interface{}) *Backend {
+	n := atomic.AddUint32(&r.next, 1) - 1
+	return backends[n%uint32(len(backends))]
+}
+
+type leastPending struct{}
+
+// backend which has fewest running calls, ties are broken randomly
+func LeastPending() Balancer {
+	return leastPending{}
+}
+
+func (leastPending) Pick(backends []*Backend, method string, argv interface{}) *Backend {
+	offset := rand.Intn(len(backends))
+	var best *Backend
+	for i := range backends {
+		b := backends[(offset+i)%len(backends)]
+		if best == nil || b.Pending() < best.Pending() {
+			best = b
+		}
+	}
+	return best
+}
+
+type consistentHash struct {
+	key func(method string, argv interface{}) string
+}
+
+// requests of same key go to same backend while it's healthy,
+// only keys of a backend move when it's ejected (rendezvous hashing)
+func ConsistentHash(key func(method string, argv interface{}) string) Balancer {
+	return &consistentHash{key: key}
+}
+
+func (h *consistentHash) Pick(backends []*Backend, method string, argv interface{}) *Backend {
+	key := h.key(method, argv)
+	var best *Backend
+	var bestScore uint64
+	for _, b := range backends {
+		hash := fnv.New64a()
+		hash.Write([]byte(b.Address))
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+		if score := hash.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+const (
+	DefaultMaxFailures         = 3
+	DefaultHealthCheckInterval = time.Second
+)
+
+type Pool struct {
+	*Rpc
+	backends []*Backend
+
+	// fields below should be set before Start, they apply to every backend
+	Balancer    Balancer // RoundRobin if nil
+	Dial        func(network, address string) (net.Conn, error)
+	Setup       func(*Client) error
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxFailures int // DefaultMaxFailures if zero
+	// check backends periodically, a connected backend is healthy if HealthCheck is nil
+	HealthCheck         func(ctx context.Context, client *Client) error
+	HealthCheckInterval time.Duration
+
+	hedgeMu       sync.RWMutex
+	hedgePolicies map[string]*HedgePolicy
+
+	once sync.Once
+	quit chan struct{}
+}
+
+/*
+	hedged request
+	send the request to another backend if no reply arrives in Delay, or
+	the last attempt fails with a retryable code. the first reply wins and
+	the other attempts are canceled. only idempotent methods are hedged,
+	a module policy doesn't apply to other methods of the module
+*/
+type HedgePolicy struct {
+	MaxAttempts int // including the first one, each on a different backend
+	Delay       time.Duration
+}
+
+func (bridge *Bridge) NewPool(network string, addresses []string) *Pool {
+	rpc := NewRpc(bridge)
+	pool := &Pool{
+		Rpc:  &rpc,
+		quit: make(chan struct{}),
+	}
+	for _, address := range addresses {
+		pool.backends = append(pool.backends, &Backend{
+			ReconnectClient: newReconnectClient(pool.Rpc, network, address),
+			Address:         address,
+		})
+	}
+	return pool
+}
+
+func (pool *Pool) Backends() []*Backend {
+	return pool.backends
+}
+
+func (pool *Pool) Start() {
+	for _, b := range pool.backends {
+		b.Dial = pool.Dial
+		b.Setup = pool.Setup
+		b.MinBackoff = pool.MinBackoff
+		b.MaxBackoff = pool.MaxBackoff
+		b.Start()
+	}
+	if pool.Balancer == nil {
+		pool.Balancer = RoundRobin()
+	}
+	go pool.checkHealth()
+}
+
+func (pool *Pool) Close() error {
+	pool.once.Do(func() {
+		close(pool.quit)
+	})
+	for _, b := range pool.backends {
+		b.Close()
+	}
+	return nil
+}
+
+func (pool *Pool) checkHealth() {
+	interval := pool.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-pool.quit:
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, b := range pool.backends {
+			wg.Add(1)
+			go func(b *Backend) {
+				defer wg.Done()
+				pool.check(b, interval)
+			}(b)
+		}
+		wg.Wait()
+	}
+}
+
+func (pool *Pool) check(b *Backend, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cli, err := b.Conn(ctx)
+	if err == nil && pool.HealthCheck != nil {
+		err = pool.HealthCheck(ctx, cli)
+	}
+	if err != nil {
+		b.eject()
+		return
+	}
+	b.restore()
+}
+
+// failure of connection or server overload counts, errors returned by services don't
+func isBackendFailure(callError *CallError) bool {
+	if callError == nil {
+		return false
+	}
+	if !callError.IsRpcError() {
+		return !callError.IsCanceled()
+	}
+	return callError.Code == ErrCodeUnavailable || callError.Code == ErrCodeOverload
+}
+
+func (pool *Pool) record(b *Backend, callError *CallError) {
+	// canceled attempts, e.g. losers of hedged requests, tell nothing of the backend
+	if callError.IsCanceled() {
+		return
+	}
+	if !isBackendFailure(callError) {
+		atomic.StoreInt32(&b.failures, 0)
+		return
+	}
+	max := pool.MaxFailures
+	if max <= 0 {
+		max = DefaultMaxFailures
+	}
+	if int(atomic.AddInt32(&b.failures, 1)) >= max {
+		b.eject()
+	}
+}
+
+// set hedge policy of method or all methods of module, nil policy disables hedging
+func (pool *Pool) SetHedgePolicy(name string, policy *HedgePolicy) error {
+	dptor := pool.getDescriptor(name)
+	if dptor == nil && !pool.bridge.hasModule(name) {
+		return fmt.Errorf("unknown method or module:%s", name)
+	}
+	if dptor != nil && policy != nil && !dptor.Idempotent {
+		return fmt.Errorf("method %s is not idempotent", name)
+	}
+
+	pool.hedgeMu.Lock()
+	defer pool.hedgeMu.Unlock()
+	if pool.hedgePolicies == nil {
+		pool.hedgePolicies = make(map[string]*HedgePolicy)
+	}
+	pool.hedgePolicies[name] = policy
+	return nil
+}
+
+func (pool *Pool) hedgePolicy(dptor *Descriptor) *HedgePolicy {
+	pool.hedgeMu.RLock()
+	defer pool.hedgeMu.RUnlock()
+	if policy, ok := pool.hedgePolicies[dptor.NormalName]; ok {
+		return policy
+	}
+	return pool.hedgePolicies[dptor.Module()]
+}
+
+// backends in exclude are skipped
+func (pool *Pool) pick(method string, argv interface{}, exclude map[*Backend]bool) (*Backend, *CallError) {
+	var healthy []*Backend
+	for _, b := range pool.backends {
+		if b.Healthy() && !exclude[b] {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, NewCallError(ErrCodeUnavailable, "no available backend")
+	}
+	return pool.Balancer.Pick(healthy, method, argv), nil
+}
+
+// call a backend chosen by Balancer, every retry or hedged attempt picks again
+func (pool *Pool) CallContext(ctx context.Context, method string, argv interface{}, reply interface{}) (*CallError, error) {
+	var policy *RetryPolicy
+	dptor := pool.getDescriptor(method)
+	if dptor != nil {
+		policy = pool.retryPolicy(dptor)
+		if hedge := pool.hedgePolicy(dptor); hedge != nil && hedge.MaxAttempts > 1 && dptor.Idempotent && dptor.ReplyType != nil {
+			return pool.hedge(ctx, dptor, hedge, policy, argv, reply)
+		}
+	}
+	return retryCall(ctx, dptor, policy, func() (*CallError, error) {
+		b, callError := pool.pick(method, argv, nil)
+		if callError != nil {
+			return callError, nil
+		}
+		return pool.callBackend(ctx, b, method, argv, reply)
+	})
+}
+
+// one attempt on backend b
+func (pool *Pool) callBackend(ctx context.Context, b *Backend, method string, argv interface{}, reply interface{}) (*CallError, error) {
+	atomic.AddInt32(&b.pending, 1)
+	callError, err := b.callOnce(ctx, method, argv, reply)
+	atomic.AddInt32(&b.pending, -1)
+	if err != nil {
+		return nil, err
+	}
+	pool.record(b, callError)
+	return callError, nil
+}
+
+type hedgeResult struct {
+	reply     interface{}
+	callError *CallError
+	err       error
+}
+
+func (pool *Pool) hedge(ctx context.Context, dptor *Descriptor, policy *HedgePolicy, retry *RetryPolicy, argv interface{}, reply interface{}) (*CallError, error) {
+	// argv and reply are checked once here, so attempts only fail by rpc errors
+	if !dptor.MatchArgType(reflect.TypeOf(argv)) || !dptor.MatchReplyType(reflect.TypeOf(reply)) {
+		return nil, fmt.Errorf("method %s argv or reply type mismatch", dptor.NormalName)
+	}
+	retryable := DefaultRetryableCodes
+	if retry != nil && retry.RetryableCodes != nil {
+		retryable = retry.RetryableCodes
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered, so losing attempts never block
+	results := make(chan hedgeResult, policy.MaxAttempts)
+	tried := make(map[*Backend]bool)
+	launch := func() *CallError {
+		b, callError := pool.pick(dptor.NormalName, argv, tried)
+		if callError != nil {
+			return callError
+		}
+		tried[b] = true
+		r := reflect.New(dptor.ReplyType.Elem()).Interface()
+		go func() {
+			callError, err := pool.callBackend(ctx, b, dptor.NormalName, argv, r)
+			results <- hedgeResult{r, callError, err}
+		}()
+		return nil
+	}
+
+	if callError := launch(); callError != nil {
+		return callError, nil
+	}
+	running := 1
+	timer := time.NewTimer(policy.Delay)
+	defer timer.Stop()
+
+	var last hedgeResult
+	for running > 0 {
+		select {
+		case <-timer.C:
+			if len(tried) < policy.MaxAttempts && launch() == nil {
+				running++
+				timer.Reset(policy.Delay)
+			}
+		case res := <-results:
+			running--
+			if res.err != nil || res.callError == nil || !isRetryable(res.callError, retryable) {
+				if res.err == nil && res.callError == nil {
+					reply.(proto.Message).Reset()
+					proto.Merge(reply.(proto.Message), res.reply.(proto.Message))
+				}
+				return res.callError, res.err
+			}
+			last = res
+			if len(tried) < policy.MaxAttempts && launch() == nil {
+				running++
+			}
+		}
+	}
+	return last.callError, last.err
+}
+
+func (pool *Pool) Call(method string, argv interface{}, reply interface{}) (*CallError, error) {
+	return pool.CallContext(context.Background(), method, argv, reply)
+}
+
+// same as Call except it panics if method, argv and reply do not match
+func (pool *Pool) MustCall(method string, argv interface{}, reply interface{}) *CallError {
+	callError, err := pool.Call(method, argv, reply)
+	if err != nil {
+		log.Panicf("MustCall failed: method:%s, argv:%v", method, argv)
+	}
+	return callError
+}
+
+// invoke a backend chosen by Balancer
+func (pool *Pool) InvokeContext(ctx context.Context, method string, argv interface{}) error {
+	b, callError := pool.pick(method, argv, nil)
+	if callError != nil {
+		return callError
+	}
+	err := b.InvokeContext(ctx, method, argv)
+	if err == nil {
+		pool.record(b, nil)
+	} else if callError, ok := err.(*CallError); ok {
+		pool.record(b, callError)
+	}
+	return err
+}
+
+func (pool *Pool) Invoke(method string, argv interface{}) error {
+	return pool.InvokeContext(context.Background(), method, argv)
+}
+
+// open stream on a backend chosen by Balancer, argv passed to Balancer is nil
+func (pool *Pool) OpenStream(ctx context.Context, method string) (*Stream, error) {
+	b, callError := pool.pick(method, nil, nil)
+	if callError != nil {
+		return nil, callError
+	}
+	return b.OpenStream(ctx, method)
+}
@@ -0,0 +1,328 @@
+package rpc
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	client which redials when the connection is down
+	modules, interceptors and orderings are registered once on the ReconnectClient
+	and shared by every connection. calls pending when a connection drops fail,
+	calls made while disconnected fail with ErrCodeUnavailable, or wait for next
+	connection if QueueWhileDisconnected is set
+*/
+type ConnState int32
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+type ReconnectClient struct {
+	*Rpc
+	network string
+	address string
+
+	// fields below should be set before Start
+
+	// dial a connection, net.Dial if nil
+	Dial func(network, address string) (net.Conn, error)
+	// runs on every new connection before it's used, Serve is already running.
+	// e.g. SetFraming, Authenticate. connection is dropped if it returns error
+	Setup func(*Client) error
+	// called on every state change, in the reconnecting goroutine
+	OnStateChange func(ConnState)
+	// delay before redial grows from MinBackoff to MaxBackoff, with jitter.
+	// it's reset after a connection stays up for MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// calls wait for connection instead of failing when disconnected
+	QueueWhileDisconnected bool
+
+	mu      sync.Mutex
+	started bool
+	state   ConnState
+	current *Client
+	ready   chan struct{} // closed when connected
+	quit    chan struct{}
+	once    sync.Once
+	done    chan struct{}
+}
+
+func (bridge *Bridge) NewReconnectClient(network, address string) *ReconnectClient {
+	rpc := NewRpc(bridge)
+	return newReconnectClient(&rpc, network, address)
+}
+
+// connections of clients sharing rpc have same modules
+func newReconnectClient(rpc *Rpc, network, address string) *ReconnectClient {
+	return &ReconnectClient{
+		Rpc:     rpc,
+		network: network,
+		address: address,
+		ready:   make(chan struct{}),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// start connecting in background
+func (rc *ReconnectClient) Start() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.started {
+		return
+	}
+	rc.started = true
+	go rc.run()
+}
+
+func (rc *ReconnectClient) State() ConnState {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.state
+}
+
+func (rc *ReconnectClient) setState(state ConnState, cli *Client) {
+	rc.mu.Lock()
+	if rc.state == state {
+		rc.mu.Unlock()
+		return
+	}
+	rc.state = state
+	rc.current = cli
+	if state == StateConnected {
+		close(rc.ready)
+	} else if isClosed(rc.ready) {
+		rc.ready = make(chan struct{})
+	}
+	rc.mu.Unlock()
+
+	if rc.OnStateChange != nil {
+		rc.OnStateChange(state)
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rc *ReconnectClient) backoffRange() (min, max time.Duration) {
+	min, max = rc.MinBackoff, rc.MaxBackoff
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max < min {
+		max = DefaultMaxBackoff
+		if max < min {
+			max = min
+		}
+	}
+	return
+}
+
+func (rc *ReconnectClient) backoff(attempt int) time.Duration {
+	min, max := rc.backoffRange()
+	return backoffDelay(min, max, attempt)
+}
+
+func (rc *ReconnectClient) connect() (*Client, error) {
+	dial := rc.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial(rc.network, rc.address)
+	if err != nil {
+		return nil, err
+	}
+
+	cli := &Client{Rpc: rc.Rpc}
+	cli.Context = NewContext(cli, conn)
+	go cli.Serve()
+	if rc.Setup != nil {
+		if err := rc.Setup(cli); err != nil {
+			cli.Close()
+			return nil, err
+		}
+	}
+	return cli, nil
+}
+
+func (rc *ReconnectClient) run() {
+	defer close(rc.done)
+	attempt := 0
+	for {
+		rc.setState(StateConnecting, nil)
+		cli, err := rc.connect()
+		if err != nil {
+			log.Printf("connect %s failed: %v", rc.address, err)
+		} else {
+			connected := time.Now()
+			rc.setState(StateConnected, cli)
+			select {
+			case <-cli.endpoint.ctx.Done():
+				log.Printf("connection to %s is down", rc.address)
+			case <-rc.quit:
+				cli.Close()
+				rc.setState(StateClosed, nil)
+				return
+			}
+			// peer which drops connections at once is not hammered
+			if _, max := rc.backoffRange(); time.Since(connected) >= max {
+				attempt = 0
+			}
+		}
+
+		rc.setState(StateDisconnected, nil)
+		select {
+		case <-time.After(rc.backoff(attempt)):
+			attempt++
+		case <-rc.quit:
+			rc.setState(StateClosed, nil)
+			return
+		}
+	}
+}
+
+// stop reconnecting and close current connection
+func (rc *ReconnectClient) Close() error {
+	rc.once.Do(func() {
+		close(rc.quit)
+	})
+	rc.mu.Lock()
+	started := rc.started
+	rc.started = true // no more Start
+	rc.mu.Unlock()
+	if started {
+		<-rc.done
+	} else {
+		rc.setState(StateClosed, nil)
+	}
+	return nil
+}
+
+// current connection, waits for connection if QueueWhileDisconnected is set
+func (rc *ReconnectClient) Conn(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.Lock()
+		cli, ready, state := rc.current, rc.ready, rc.state
+		rc.mu.Unlock()
+
+		if state == StateClosed {
+			return nil, NewCallError(ErrCodeUnavailable, "client closed")
+		}
+		if cli != nil {
+			return cli, nil
+		}
+		if !rc.QueueWhileDisconnected {
+			return nil, NewCallError(ErrCodeUnavailable, "not connected")
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, contextCallError(ctx.Err())
+		case <-rc.quit:
+			return nil, NewCallError(ErrCodeUnavailable, "client closed")
+		}
+	}
+}
+
+// same as Context.GoContext on current connection
+func (rc *ReconnectClient) GoContext(ctx context.Context, method string, argv interface{}, reply interface{}, done chan *Call) (*Call, error) {
+	cli, err := rc.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cli.GoContext(ctx, method, argv, reply, done)
+}
+
+func (rc *ReconnectClient) Go(method string, argv interface{}, reply interface{}, done chan *Call) (*Call, error) {
+	return rc.GoContext(context.Background(), method, argv, reply, done)
+}
+
+// same as Context.CallContext on current connection, not connected is reported as CallError.
+// retried call may be sent on a new connection
+func (rc *ReconnectClient) CallContext(ctx context.Context, method string, argv interface{}, reply interface{}) (*CallError, error) {
+	var policy *RetryPolicy
+	dptor := rc.getDescriptor(method)
+	if dptor != nil {
+		policy = rc.retryPolicy(dptor)
+	}
+	return retryCall(ctx, dptor, policy, func() (*CallError, error) {
+		return rc.callOnce(ctx, method, argv, reply)
+	})
+}
+
+func (rc *ReconnectClient) callOnce(ctx context.Context, method string, argv interface{}, reply interface{}) (*CallError, error) {
+	cli, err := rc.Conn(ctx)
+	if err != nil {
+		return err.(*CallError), nil
+	}
+	return cli.callOnce(ctx, method, argv, reply)
+}
+
+func (rc *ReconnectClient) Call(method string, argv interface{}, reply interface{}) (*CallError, error) {
+	return rc.CallContext(context.Background(), method, argv, reply)
+}
+
+// same as Call except it panics if method, argv and reply do not match
+func (rc *ReconnectClient) MustCall(method string, argv interface{}, reply interface{}) *CallError {
+	callError, err := rc.Call(method, argv, reply)
+	if err != nil {
+		log.Panicf("MustCall failed: method:%s, argv:%v", method, argv)
+	}
+	return callError
+}
+
+// same as Context.InvokeContext on current connection
+func (rc *ReconnectClient) InvokeContext(ctx context.Context, method string, argv interface{}) error {
+	cli, err := rc.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	return cli.InvokeContext(ctx, method, argv)
+}
+
+func (rc *ReconnectClient) Invoke(method string, argv interface{}) error {
+	return rc.InvokeContext(context.Background(), method, argv)
+}
+
+// same as Context.OpenStream on current connection
+func (rc *ReconnectClient) OpenStream(ctx context.Context, method string) (*Stream, error) {
+	cli, err := rc.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cli.OpenStream(ctx, method)
+}
@@ -0,0 +1,165 @@
+package rpc
+
+import (
+	"fmt"
+	"log"
+)
+
+// find live context by id, return nil if not found
+func (server *Server) Lookup(id uint64) *Context {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+	return server.contexts[id]
+}
+
+// call f for every live context until f returns false
+func (server *Server) Range(f func(*Context) bool) {
+	for _, context := range server.snapshot() {
+		if !f(context) {
+			break
+		}
+	}
+}
+
+// number of live contexts
+func (server *Server) NumContexts() int {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+	return len(server.contexts)
+}
+
+func (server *Server) snapshot() []*Context {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+	contexts := make([]*Context, 0, len(server.contexts))
+	for _, context := range server.contexts {
+		contexts = append(contexts, context)
+	}
+	return contexts
+}
+
+// invoke method on every live context, return number of contexts invoked.
+// contexts whose write queue is full are skipped
+func (server *Server) Broadcast(method string, argv interface{}) (int, error) {
+	return server.invokeAll(server.snapshot(), method, argv)
+}
+
+// invoke method on contexts of ids, unknown ids are skipped
+func (server *Server) Multicast(ids []uint64, method string, argv interface{}) (int, error) {
+	server.smu.Lock()
+	contexts := make([]*Context, 0, len(ids))
+	for _, id := range ids {
+		if context, ok := server.contexts[id]; ok {
+			contexts = append(contexts, context)
+		}
+	}
+	server.smu.Unlock()
+	return server.invokeAll(contexts, method, argv)
+}
+
+// invoke method on contexts selected by f
+func (server *Server) MulticastFunc(f func(*Context) bool, method string, argv interface{}) (int, error) {
+	var contexts []*Context
+	for _, context := range server.snapshot() {
+		if f(context) {
+			contexts = append(contexts, context)
+		}
+	}
+	return server.invokeAll(contexts, method, argv)
+}
+
+// failure of a single context is logged and skipped.
+// it never waits for a slow peer, context whose write queue is full is skipped
+func (server *Server) invokeAll(contexts []*Context, method string, argv interface{}) (int, error) {
+	dptor, err := invokeDescriptor(server, method, argv)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, context := range contexts {
+		if err := context.fanout(dptor, argv); err != nil {
+			log.Printf("invoke %s on context %d failed: %v", method, context.Id(), err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// add context to group, context leaves all groups automatically when closed
+func (server *Server) Join(group string, context *Context) error {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+
+	id := context.Id()
+	if _, ok := server.contexts[id]; !ok {
+		return fmt.Errorf("join group %s: context %d is not alive", group, id)
+	}
+
+	members := server.groups[group]
+	if members == nil {
+		members = make(map[uint64]*Context)
+		server.groups[group] = members
+	}
+	members[id] = server.contexts[id]
+
+	groups := server.joined[id]
+	if groups == nil {
+		groups = make(map[string]bool)
+		server.joined[id] = groups
+	}
+	groups[group] = true
+	return nil
+}
+
+// remove context from group
+func (server *Server) Leave(group string, context *Context) {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+	server.leave(group, context.Id())
+}
+
+// must hold smu
+func (server *Server) leave(group string, id uint64) {
+	if members := server.groups[group]; members != nil {
+		delete(members, id)
+		if len(members) == 0 {
+			delete(server.groups, group)
+		}
+	}
+	if groups := server.joined[id]; groups != nil {
+		delete(groups, group)
+		if len(groups) == 0 {
+			delete(server.joined, id)
+		}
+	}
+}
+
+// live contexts in group
+func (server *Server) Members(group string) []*Context {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+	members := server.groups[group]
+	contexts := make([]*Context, 0, len(members))
+	for _, context := range members {
+		contexts = append(contexts, context)
+	}
+	return contexts
+}
+
+// groups joined by context
+func (server *Server) Groups(context *Context) []string {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+	var groups []string
+	for group := range server.joined[context.Id()] {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// invoke method on every member of group
+func (server *Server) InvokeGroup(group string, method string, argv interface{}) (int, error) {
+	return server.invokeAll(server.Members(group), method, argv)
+}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+	retry of failed calls
+	a method is retried if a RetryPolicy is set for it or its module,
+	or it's marked idempotent in protolist, which uses DefaultRetryPolicy.
+	Call and CallContext retry, Go doesn't
+*/
+type RetryPolicy struct {
+	MaxAttempts    int // including the first one
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	RetryableCodes []int32 // DefaultRetryableCodes if nil
+}
+
+/*
+	codes retried if RetryableCodes is nil. overload and full queue mean the request
+	is not handled, but calls already sent also fail with ErrCodeUnavailable when
+	connection is lost, so it's retried only for idempotent methods
+*/
+var DefaultRetryableCodes = []int32{ErrCodeUnavailable, ErrCodeOverload, ErrCodeQueueFull}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+}
+
+/*
+	set retry policy of method (e.g. "test.echo") or all methods of module (e.g. "test")
+	nil policy disables retry, even if the method is idempotent
+*/
+func (r *Rpc) SetRetryPolicy(name string, policy *RetryPolicy) error {
+	if r.getDescriptor(name) == nil && !r.bridge.hasModule(name) {
+		return fmt.Errorf("unknown method or module:%s", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.retryPolicies == nil {
+		r.retryPolicies = make(map[string]*RetryPolicy)
+	}
+	r.retryPolicies[name] = policy
+	return nil
+}
+
+// method setting takes precedence over module setting
+func (r *Rpc) retryPolicy(dptor *Descriptor) *RetryPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if policy, ok := r.retryPolicies[dptor.NormalName]; ok {
+		return policy
+	}
+	if policy, ok := r.retryPolicies[dptor.Module()]; ok {
+		return policy
+	}
+	if dptor.Idempotent {
+		return &DefaultRetryPolicy
+	}
+	return nil
+}
+
+func (p *RetryPolicy) retryable(dptor *Descriptor, callError *CallError) bool {
+	codes := p.RetryableCodes
+	if codes == nil {
+		if callError.Code == ErrCodeUnavailable && !dptor.Idempotent {
+			return false
+		}
+		codes = DefaultRetryableCodes
+	}
+	return isRetryable(callError, codes)
+}
+
+func isRetryable(callError *CallError, codes []int32) bool {
+	for _, code := range codes {
+		if callError.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// exponential backoff from min to max with jitter in [d/2, d)
+func backoffDelay(min, max time.Duration, attempt int) time.Duration {
+	if min <= 0 {
+		return 0
+	}
+	if max < min {
+		max = min
+	}
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// run attempt until it succeeds, fails with a code not retryable, or attempts run out
+func retryCall(ctx context.Context, dptor *Descriptor, policy *RetryPolicy, attempt func() (*CallError, error)) (*CallError, error) {
+	for i := 0; ; i++ {
+		callError, err := attempt()
+		if err != nil || callError == nil || policy == nil ||
+			i+1 >= policy.MaxAttempts || !policy.retryable(dptor, callError) {
+			return callError, err
+		}
+
+		select {
+		case <-time.After(backoffDelay(policy.InitialBackoff, policy.MaxBackoff, i)):
+		case <-ctx.Done():
+			return callError, nil
+		}
+	}
+}
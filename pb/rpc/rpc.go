@@ -5,7 +5,9 @@ package rpc
 
 import (
 	"fmt"
+	"log"
 	"reflect"
+	"runtime/debug"
 	"sync"
 )
 
@@ -13,6 +15,16 @@ type Rpc struct {
 	mu         sync.RWMutex
 	serviceMap map[int32]*service
 	bridge     *Bridge
+
+	serverInterceptors []ServerInterceptor
+	clientInterceptors []ClientInterceptor
+	serverChain        ServerInterceptor
+	clientChain        ClientInterceptor
+	orderings          map[string]*ordering
+	retryPolicies      map[string]*RetryPolicy
+
+	// called after a service panics, stack is the trace of panicking goroutine
+	PanicHandler func(c *Context, dptor *Descriptor, err interface{}, stack []byte)
 }
 
 func NewRpc(bridge *Bridge) Rpc {
@@ -50,28 +62,109 @@ func (r *Rpc) RegisterModule(receiver interface{}) error {
 func (r *Rpc) register(rcvr reflect.Value, typ reflect.Type) error {
 	module := reflect.Indirect(rcvr).Type().Name()
 	for m := 0; m < typ.NumMethod(); m++ {
-		method := typ.Method(m)
-
-		dptor := r.bridge.getDescriptor(module, method.Name)
-		if dptor == nil {
-			return fmt.Errorf("undefined method %s.%s", module, method.Name)
+		if err := r.registerMethod(module, rcvr, typ.Method(m)); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+func (r *Rpc) registerMethod(module string, rcvr reflect.Value, method reflect.Method) error {
+	dptor := r.bridge.getDescriptor(module, method.Name)
+	if dptor == nil {
+		return fmt.Errorf("undefined method %s.%s", module, method.Name)
+	}
+
+	if err := dptor.MatchMethod(method); err != nil {
+		return err
+	}
+
+	if _, present := r.serviceMap[dptor.Id]; present {
+		return fmt.Errorf("repeated method %s", dptor.MethodName)
+	}
+
+	r.serviceMap[dptor.Id] = &service{
+		rcvr:     rcvr,
+		receiver: rcvr.Interface(),
+		method:   method,
+		dptor:    dptor,
+	}
+	return nil
+}
+
+// implemented by Server and Client, used by generated RegisterXxxServer
+type ServiceRegistrar interface {
+	RegisterService(module string, iface reflect.Type, receiver interface{}) error
+}
+
+/*
+	注册模块，模块名由参数给出 (e.g. "Test")，receiver的类型可以任意命名
+	只注册接口iface中的函数，receiver可以有其他函数
+	iface is an interface type, e.g. reflect.TypeOf((*TestServer)(nil)).Elem()
+*/
+func (r *Rpc) RegisterService(module string, iface reflect.Type, receiver interface{}) error {
+	if iface.Kind() != reflect.Interface {
+		return fmt.Errorf("register %s: %s is not an interface", module, iface.String())
+	}
+	rcvr := reflect.ValueOf(receiver)
+	if !rcvr.IsValid() || !rcvr.Type().Implements(iface) {
+		return fmt.Errorf("register %s: receiver does not implement %s", module, iface.String())
+	}
 
-		if err := dptor.MatchMethod(method); err != nil {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for m := 0; m < iface.NumMethod(); m++ {
+		method, _ := rcvr.Type().MethodByName(iface.Method(m).Name)
+		if err := r.registerMethod(module, rcvr, method); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		if _, present := r.serviceMap[dptor.Id]; present {
-			return fmt.Errorf("repeated method %s", dptor.MethodName)
-		}
+// add interceptors of incoming requests, they run in the order added
+func (r *Rpc) Intercept(interceptors ...ServerInterceptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serverInterceptors = append(r.serverInterceptors, interceptors...)
+	r.serverChain = chainServerInterceptors(r.serverInterceptors)
+}
 
-		r.serviceMap[dptor.Id] = &service{
-			rcvr:   rcvr,
-			method: method,
-			dptor:  dptor,
+// add interceptors of outgoing calls and invokes, they run in the order added
+func (r *Rpc) InterceptOutgoing(interceptors ...ClientInterceptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clientInterceptors = append(r.clientInterceptors, interceptors...)
+	r.clientChain = chainClientInterceptors(r.clientInterceptors)
+}
+
+func (r *Rpc) clientInterceptor() ClientInterceptor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clientChain
+}
+
+// run service through interceptors
+// a panic is recovered and turned into an internal error
+func (r *Rpc) handle(c *Context, s *service, argv, reply interface{}) (callError *CallError) {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("service %s panic: %v\n%s", s.dptor.NormalName, err, stack)
+			if r.PanicHandler != nil {
+				r.PanicHandler(c, s.dptor, err, stack)
+			}
+			callError = NewCallError(ErrCodeInternal, "%s: internal error", s.dptor.NormalName)
 		}
+	}()
+
+	r.mu.RLock()
+	interceptor := r.serverChain
+	r.mu.RUnlock()
+	if interceptor == nil {
+		return s.handle(c, argv, reply)
 	}
-	return nil
+	return interceptor(c, s.dptor, argv, reply, s.handle)
 }
 
 func (r *Rpc) getService(typ int32) *service {
@@ -0,0 +1,1977 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/base"
+	"github.com/xjdrew/daisy/gen/proto/test"
+)
+
+var testDescriptors = []Descriptor{
+	{
+		Id:         100001,
+		NormalName: "test.echo",
+		MethodName: "Test.Echo",
+		ArgType:    reflect.TypeOf(&proto_test.Echo{}),
+		ReplyType:  reflect.TypeOf(&proto_test.Echo_Response{}),
+	},
+	{
+		Id:         100002,
+		NormalName: "test.strobe",
+		MethodName: "Test.Strobe",
+		ArgType:    reflect.TypeOf(&proto_test.Strobe{}),
+		ReplyType:  nil,
+	},
+	{
+		Id:         100003,
+		NormalName: "test.chat",
+		MethodName: "Test.Chat",
+		ArgType:    reflect.TypeOf(&proto_test.Echo{}),
+		ReplyType:  reflect.TypeOf(&proto_test.Echo_Response{}),
+		Stream:     BidiStream,
+	},
+	{
+		Id:         100004,
+		NormalName: "test.count",
+		MethodName: "Test.Count",
+		ArgType:    reflect.TypeOf(&proto_test.Echo{}),
+		ReplyType:  reflect.TypeOf(&proto_test.Echo_Response{}),
+		Stream:     ServerStream,
+	},
+}
+
+type Test struct {
+	strobe   chan string
+	release  chan struct{}
+	canceled chan error
+	counted  int32
+}
+
+func (t *Test) Echo(context *Context, req *proto_test.Echo, rsp *proto_test.Echo_Response) *CallError {
+	switch req.GetReq() {
+	case "block":
+		<-t.release
+	case "panic":
+		panic("echo panic")
+	case "wait":
+		<-context.Done()
+		t.canceled <- context.Err()
+	}
+	rsp.Resp = req.Req
+	return nil
+}
+
+func (t *Test) Strobe(context *Context, req *proto_test.Strobe) {
+	t.strobe <- req.GetMsg()
+}
+
+// echo every message, fails on "fail"
+func (t *Test) Chat(context *Context, stream *Stream) *CallError {
+	for {
+		var req proto_test.Echo
+		if err := stream.Recv(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return NewCallError(1, err.Error())
+		}
+		if req.GetReq() == "fail" {
+			return NewCallError(7, "chat failed")
+		}
+		if err := stream.Send(&proto_test.Echo_Response{Resp: req.Req}); err != nil {
+			return NewCallError(1, err.Error())
+		}
+	}
+}
+
+// send numbers from 0 to req
+func (t *Test) Count(context *Context, stream *Stream) *CallError {
+	var req proto_test.Echo
+	if err := stream.Recv(&req); err != nil {
+		return NewCallError(1, err.Error())
+	}
+	n, _ := strconv.Atoi(req.GetReq())
+	for i := 0; i < n; i++ {
+		if err := stream.Send(&proto_test.Echo_Response{Resp: proto.String(strconv.Itoa(i))}); err != nil {
+			return NewCallError(1, err.Error())
+		}
+		atomic.AddInt32(&t.counted, 1)
+	}
+	return nil
+}
+
+// server listens on loopback, setups run before the connection is served
+func newTestPair(t testing.TB, serverSetup func(*Server), clientSetup func(*Client)) (*Server, *Client, *Test) {
+	bridge := NewBridge(testDescriptors)
+	server := bridge.NewServer()
+	impl := &Test{strobe: make(chan string, 16), release: make(chan struct{}), canceled: make(chan error, 1)}
+	if err := server.RegisterModule(impl); err != nil {
+		t.Fatal(err)
+	}
+	if serverSetup != nil {
+		serverSetup(server)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+
+	client, err := bridge.Dail("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientSetup != nil {
+		clientSetup(client)
+	}
+	go client.Serve()
+	return server, client, impl
+}
+
+func TestChunkedCall(t *testing.T) {
+	_, client, impl := newTestPair(t, func(server *Server) {
+		server.MaxFrameSize = 1024
+	}, func(client *Client) {
+		client.SetMaxFrameSize(1024)
+	})
+	defer client.Close()
+
+	msg := strings.Repeat("daisy", 1000)
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String(msg)}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if rsp.GetResp() != msg {
+		t.Fatalf("unexpected echo response, len %d", len(rsp.GetResp()))
+	}
+
+	client.MustInvoke("test.strobe", &proto_test.Strobe{Msg: proto.String(msg)})
+	if got := <-impl.strobe; got != msg {
+		t.Fatalf("unexpected strobe, len %d", len(got))
+	}
+}
+
+// chunks fit in the smaller max frame size of two sides after negotiation
+func TestChunkToPeerFrameSize(t *testing.T) {
+	_, client, _ := newTestPair(t, func(server *Server) {
+		server.MaxFrameSize = 1024
+	}, func(client *Client) {
+		client.SetMaxFrameSize(2048)
+	})
+	defer client.Close()
+
+	// wait for serve, so SetFraming waits for the answer of server
+	for atomic.LoadInt32(&client.serving) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.SetFraming(FramingVarint); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := strings.Repeat("daisy", 1000)
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String(msg)}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if rsp.GetResp() != msg {
+		t.Fatalf("unexpected echo response, len %d", len(rsp.GetResp()))
+	}
+	if size := client.chunkSize(); size != 1024-chunkOverhead {
+		t.Fatalf("unexpected chunk size %d", size)
+	}
+}
+
+func TestMaxPendingSize(t *testing.T) {
+	_, client, _ := newTestPair(t, func(server *Server) {
+		server.MaxPendingSize = 4096
+	}, nil)
+	defer client.Close()
+
+	// first chunks of many sessions, none of them is finished
+	for i := 0; i < 10; i++ {
+		chunk := &proto_base.Pack{
+			Session: proto.Int32(client.nextSession()),
+			Type:    proto.Int32(testDescriptors[0].Id),
+			Data:    make([]byte, 1000),
+			More:    proto.Bool(true),
+		}
+		if err := client.enqueue(chunk, frameOther); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr == nil {
+		t.Fatal("connection should be closed by server")
+	}
+}
+
+func TestCallContextTimeout(t *testing.T) {
+	_, client, impl := newTestPair(t, nil, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var rsp proto_test.Echo_Response
+	callErr, err := client.CallContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("block")}, &rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !callErr.IsTimeout() {
+		t.Fatalf("expect timeout, got %v", callErr)
+	}
+	close(impl.release)
+
+	// late response is dropped, connection still works
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+}
+
+func TestLongTimeout(t *testing.T) {
+	if timeout := packTimeout(context.Background()); timeout != nil {
+		t.Fatalf("timeout without deadline: %d", *timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*24*time.Hour)
+	defer cancel()
+	if timeout := packTimeout(ctx); timeout == nil || *timeout != math.MaxInt32 {
+		t.Fatalf("timeout should be clamped, got %v", timeout)
+	}
+
+	_, client, _ := newTestPair(t, nil, nil)
+	defer client.Close()
+	var rsp proto_test.Echo_Response
+	callErr, err := client.CallContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callErr != nil {
+		t.Fatal(callErr)
+	}
+}
+
+func TestCancelPropagation(t *testing.T) {
+	_, client, impl := newTestPair(t, nil, func(client *Client) {
+		if err := client.SetFraming(FramingVarint); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer client.Close()
+
+	// caller cancels
+	ctx, cancel := context.WithCancel(context.Background())
+	call, _ := client.GoContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("wait")}, &proto_test.Echo_Response{}, nil)
+	cancel()
+	if call = <-call.Done; !call.Error.IsCanceled() {
+		t.Fatalf("expect canceled, got %v", call.Error)
+	}
+	if err := <-impl.canceled; err != context.Canceled {
+		t.Fatalf("handler expect canceled, got %v", err)
+	}
+
+	// caller's deadline passes
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go client.CallContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("wait")}, &proto_test.Echo_Response{})
+	if err := <-impl.canceled; err != context.DeadlineExceeded {
+		t.Fatalf("handler expect deadline exceeded, got %v", err)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	var trace []string
+	_, client, _ := newTestPair(t, func(server *Server) {
+		server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			if argv.(*proto_test.Echo).GetReq() == "deny" {
+				return NewCallError(403, "denied")
+			}
+			return handler(c, argv, reply)
+		})
+	}, func(client *Client) {
+		client.InterceptOutgoing(func(c *Context, call *Call, invoker Invoker) error {
+			trace = append(trace, "outer:"+call.Dptor.NormalName)
+			call.OnDone(func(call *Call) {
+				trace = append(trace, "done")
+			})
+			return invoker(c, call)
+		}, func(c *Context, call *Call, invoker Invoker) error {
+			trace = append(trace, "inner")
+			return invoker(c, call)
+		})
+	})
+	defer client.Close()
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("deny")}, &rsp); callErr == nil || callErr.Code != 403 {
+		t.Fatalf("expect denied, got %v", callErr)
+	}
+	expect := "outer:test.echo inner done outer:test.echo inner done"
+	if got := strings.Join(trace, " "); got != expect {
+		t.Fatalf("unexpected trace: %s", got)
+	}
+}
+
+func TestCallInDoneCallback(t *testing.T) {
+	retried := make(chan *CallError, 1)
+	_, client, impl := newTestPair(t, nil, func(client *Client) {
+		client.InterceptOutgoing(func(c *Context, call *Call, invoker Invoker) error {
+			if call.Argv.(*proto_test.Echo).GetReq() == "block" {
+				// call again when connection is down
+				call.OnDone(func(call *Call) {
+					again, err := c.Go("test.echo", &proto_test.Echo{Req: proto.String("again")}, &proto_test.Echo_Response{}, nil)
+					if err != nil {
+						t.Error(err)
+						retried <- nil
+						return
+					}
+					again = <-again.Done
+					retried <- again.Error
+				})
+			}
+			return invoker(c, call)
+		})
+	})
+	defer close(impl.release)
+
+	call, err := client.Go("test.echo", &proto_test.Echo{Req: proto.String("block")}, &proto_test.Echo_Response{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Close()
+	select {
+	case callErr := <-retried:
+		if callErr == nil || callErr.Code != ErrCodeUnavailable {
+			t.Fatalf("expect unavailable, got %v", callErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call in done callback is blocked")
+	}
+	if call = <-call.Done; call.Error == nil || call.Error.Code != ErrCodeUnavailable {
+		t.Fatalf("expect unavailable, got %v", call.Error)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	_, client, _ := newTestPair(t, func(server *Server) {
+		server.PanicHandler = func(c *Context, dptor *Descriptor, err interface{}, stack []byte) {
+			panics <- err
+		}
+	}, nil)
+	defer client.Close()
+
+	var rsp proto_test.Echo_Response
+	callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("panic")}, &rsp)
+	if callErr == nil || callErr.Code != ErrCodeInternal || !callErr.IsRpcError() {
+		t.Fatalf("expect internal error, got %v", callErr)
+	}
+	if err := <-panics; err != "echo panic" {
+		t.Fatalf("unexpected panic: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server, client, impl := newTestPair(t, nil, func(client *Client) {
+		if err := client.SetFraming(FramingUint16); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer client.Close()
+
+	call := client.MustGo("test.echo", &proto_test.Echo{Req: proto.String("block")}, &proto_test.Echo_Response{}, nil)
+	waitFor(t, "request runs", func() bool { return serverInFlight(server) == 1 })
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	waitFor(t, "go-away", func() bool { return atomic.LoadInt32(&client.peerLeaves) != 0 })
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returns before request finishes: %v", err)
+	default:
+	}
+
+	// peer has been told server is going away
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr.Code != ErrCodeUnavailable {
+		t.Fatalf("expect unavailable, got %v", callErr)
+	}
+
+	close(impl.release)
+	if call = <-call.Done; call.Error != nil {
+		t.Fatalf("running request should finish: %v", call.Error)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peer which never reads doesn't hang Shutdown
+func TestShutdownStuckPeer(t *testing.T) {
+	bridge := NewBridge(testDescriptors)
+	server := bridge.NewServer()
+	if err := server.RegisterModule(&Test{}); err != nil {
+		t.Fatal(err)
+	}
+	server.WriteQueueSize = 1
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+
+	client := dialStuckPeer(t, bridge, server, l.Addr().String())
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdown:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expect deadline exceeded, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown hangs on peer which never reads")
+	}
+}
+
+// client which never reads, returns when write queue of server for it is full.
+// server should have a small write queue
+func dialStuckPeer(t *testing.T, bridge *Bridge, server *Server, addr string) *Client {
+	client, err := bridge.Dail("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetFraming(FramingVarint); err != nil {
+		t.Fatal(err)
+	}
+
+	// client is not served, replies fill socket buffers then write queue of server
+	req := strings.Repeat("x", 60000)
+	for i := 0; i < 400; i++ {
+		client.Go("test.echo", &proto_test.Echo{Req: proto.String(req)}, &proto_test.Echo_Response{}, nil)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, context := range server.snapshot() {
+			if len(context.outq) == cap(context.outq) {
+				return client
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write queue is not full")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// client with a Test module to receive strobe
+func dialTest(t testing.TB, bridge *Bridge, addr string) (*Client, *Test) {
+	client, err := bridge.Dail("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := &Test{strobe: make(chan string, 16)}
+	if err := client.RegisterModule(impl); err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	return client, impl
+}
+
+// frames server sends before it reads the preamble are still read as uint16
+func TestNegotiateWhileBroadcasting(t *testing.T) {
+	bridge := NewBridge(testDescriptors)
+	server := bridge.NewServer()
+	if err := server.RegisterModule(&Test{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	defer server.Close()
+
+	client, err := bridge.Dail("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	impl := &Test{strobe: make(chan string, 1000)}
+	if err := client.RegisterModule(impl); err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	for server.NumContexts() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	const n = 500
+	go func() {
+		for i := 0; i < n; i++ {
+			// broadcast skips full queue, try again until it's sent
+			for {
+				if sent, _ := server.Broadcast("test.strobe", &proto_test.Strobe{Msg: proto.String(strconv.Itoa(i))}); sent == 1 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	// negotiate in the middle of broadcasting
+	<-impl.strobe
+	if err := client.SetFraming(FramingVarint); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < n; i++ {
+		select {
+		case <-impl.strobe:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d strobes", i)
+		}
+	}
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if f := client.codec.Framing(); f != FramingVarint {
+		t.Fatalf("client reads %s frames", f)
+	}
+}
+
+func TestBroadcastAndGroups(t *testing.T) {
+	bridge := NewBridge(testDescriptors)
+	server := bridge.NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	defer server.Close()
+
+	c1, impl1 := dialTest(t, bridge, l.Addr().String())
+	c2, impl2 := dialTest(t, bridge, l.Addr().String())
+	defer c1.Close()
+	defer c2.Close()
+	for server.NumContexts() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := server.Broadcast("test.echo", &proto_test.Echo{}); err == nil {
+		t.Fatal("broadcast a method which has a reply should fail")
+	}
+	n, err := server.Broadcast("test.strobe", &proto_test.Strobe{Msg: proto.String("all")})
+	if err != nil || n != 2 {
+		t.Fatalf("broadcast: %d, %v", n, err)
+	}
+	if <-impl1.strobe != "all" || <-impl2.strobe != "all" {
+		t.Fatal("unexpected broadcast message")
+	}
+
+	var ids []uint64
+	server.Range(func(c *Context) bool {
+		ids = append(ids, c.Id())
+		return false
+	})
+	if len(ids) != 1 || server.Lookup(ids[0]) == nil {
+		t.Fatalf("range or lookup failed: %v", ids)
+	}
+	if n, _ = server.Multicast(append(ids, 1000), "test.strobe", &proto_test.Strobe{Msg: proto.String("one")}); n != 1 {
+		t.Fatalf("multicast to %d contexts", n)
+	}
+	select {
+	case msg := <-impl1.strobe:
+		if msg != "one" {
+			t.Fatal(msg)
+		}
+	case msg := <-impl2.strobe:
+		if msg != "one" {
+			t.Fatal(msg)
+		}
+	}
+
+	// groups
+	context := server.Lookup(ids[0])
+	if err := server.Join("room", context); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ = server.InvokeGroup("room", "test.strobe", &proto_test.Strobe{Msg: proto.String("room")}); n != 1 {
+		t.Fatalf("invoke group on %d contexts", n)
+	}
+	select {
+	case <-impl1.strobe:
+	case <-impl2.strobe:
+	}
+
+	c1.Close()
+	c2.Close()
+	for server.NumContexts() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if len(server.Members("room")) != 0 || len(server.Groups(context)) != 0 {
+		t.Fatal("closed context should leave groups")
+	}
+	if err := server.Join("room", context); err == nil {
+		t.Fatal("closed context should not join group")
+	}
+}
+
+// fan-out never waits for a peer which never reads, even with QueueBlock
+func TestBroadcastStuckPeer(t *testing.T) {
+	bridge := NewBridge(testDescriptors)
+	server := bridge.NewServer()
+	if err := server.RegisterModule(&Test{}); err != nil {
+		t.Fatal(err)
+	}
+	server.WriteQueueSize = 1
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	defer server.Close()
+
+	client, impl := dialTest(t, bridge, l.Addr().String())
+	defer client.Close()
+	stuck := dialStuckPeer(t, bridge, server, l.Addr().String())
+	defer stuck.Close()
+	for server.NumContexts() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, context := range server.snapshot() {
+		if err := server.Join("room", context); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, fanout := range []func() (int, error){
+		func() (int, error) {
+			return server.Broadcast("test.strobe", &proto_test.Strobe{Msg: proto.String("all")})
+		},
+		func() (int, error) {
+			return server.InvokeGroup("room", "test.strobe", &proto_test.Strobe{Msg: proto.String("all")})
+		},
+	} {
+		done := make(chan int, 1)
+		go func() {
+			n, err := fanout()
+			if err != nil {
+				t.Error(err)
+			}
+			done <- n
+		}()
+		select {
+		case n := <-done:
+			if n != 1 {
+				t.Fatalf("fan-out to %d contexts", n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("fan-out waits for peer which never reads")
+		}
+		select {
+		case msg := <-impl.strobe:
+			if msg != "all" {
+				t.Fatalf("unexpected message: %s", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("live peer misses fan-out")
+		}
+	}
+}
+
+func TestWriteQueuePolicy(t *testing.T) {
+	bridge := NewBridge(testDescriptors)
+	for _, policy := range []QueuePolicy{QueueFail, QueueDropInvoke} {
+		// nobody reads the other end, writer blocks on the first pack
+		c1, c2 := net.Pipe()
+		client := bridge.NewClient(c1)
+		client.SetWriteQueue(1, policy)
+
+		var err error
+		for i := 0; i < 3 && err == nil; i++ {
+			err = client.Invoke("test.strobe", &proto_test.Strobe{})
+		}
+		callErr, _ := err.(*CallError)
+		switch policy {
+		case QueueFail:
+			if callErr == nil || callErr.Code != ErrCodeQueueFull {
+				t.Fatalf("expect queue full, got %v", err)
+			}
+			call := client.MustGo("test.echo", &proto_test.Echo{}, &proto_test.Echo_Response{}, nil)
+			if call = <-call.Done; call.Error.Code != ErrCodeQueueFull {
+				t.Fatalf("expect call fails, got %v", call.Error)
+			}
+		case QueueDropInvoke:
+			if err != nil {
+				t.Fatalf("invoke should be dropped, got %v", err)
+			}
+		}
+		c2.Close()
+		client.Close()
+	}
+}
+
+func TestDropChunkedInvoke(t *testing.T) {
+	bridge := NewBridge(testDescriptors)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	client := bridge.NewClient(c1)
+	defer client.Close()
+	client.SetWriteQueue(1, QueueDropInvoke)
+
+	// writer blocks on the first invoke, the second one fills the queue
+	client.MustInvoke("test.strobe", &proto_test.Strobe{})
+	waitFor(t, "writer takes invoke", func() bool { return len(client.outq) == 0 })
+	client.MustInvoke("test.strobe", &proto_test.Strobe{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Invoke("test.strobe", &proto_test.Strobe{Msg: proto.String(strings.Repeat("x", 150000))})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("invoke should be dropped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("chunks of dropped invoke are waiting for queue")
+	}
+	// no continuation chunk is queued
+	if n := len(client.outq); n != 1 {
+		t.Fatalf("%d packs in queue", n)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	server, client, impl := newTestPair(t, func(server *Server) {
+		server.MaxInFlightPerConn = 1
+	}, nil)
+	defer client.Close()
+
+	call := client.MustGo("test.echo", &proto_test.Echo{Req: proto.String("block")}, &proto_test.Echo_Response{}, nil)
+	waitFor(t, "request runs", func() bool { return serverInFlight(server) == 1 })
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr.Code != ErrCodeOverload {
+		t.Fatalf("expect overload, got %v", callErr)
+	}
+	close(impl.release)
+	if call = <-call.Done; call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+}
+
+// waiting requests don't stop reading, so a running request can be canceled
+func TestPauseOnOverload(t *testing.T) {
+	_, client, impl := newTestPair(t, func(server *Server) {
+		server.MaxInFlightPerConn = 1
+		server.PauseOnOverload = true
+	}, func(client *Client) {
+		if err := client.SetFraming(FramingVarint); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running, _ := client.GoContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("wait")}, &proto_test.Echo_Response{}, nil)
+	waiting := client.MustGo("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &proto_test.Echo_Response{}, nil)
+	cancel()
+
+	select {
+	case err := <-impl.canceled:
+		if err != context.Canceled {
+			t.Fatalf("handler expect canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancel is not read while a request waits")
+	}
+	if running = <-running.Done; !running.Error.IsCanceled() {
+		t.Fatalf("expect canceled, got %v", running.Error)
+	}
+	if waiting = <-waiting.Done; waiting.Error != nil {
+		t.Fatal(waiting.Error)
+	}
+}
+
+// open stream holds a slot, but doesn't stop the connection
+func TestPauseWithStream(t *testing.T) {
+	_, client, _ := newTestPair(t, func(server *Server) {
+		server.MaxInFlightPerConn = 1
+		server.PauseOnOverload = true
+	}, func(client *Client) {
+		if err := client.SetFraming(FramingVarint); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer client.Close()
+
+	ctx := context.Background()
+	stream, err := client.OpenStream(ctx, "test.chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rsp proto_test.Echo_Response
+	chat := func(msg string) {
+		if err := stream.Send(&proto_test.Echo{Req: proto.String(msg)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Recv(&rsp); err != nil || rsp.GetResp() != msg {
+			t.Fatalf("unexpected chat response: %q, %v", rsp.GetResp(), err)
+		}
+	}
+	chat("a")
+
+	// call waits for the slot, stream goes on
+	waiting := client.MustGo("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &proto_test.Echo_Response{}, nil)
+	chat("b")
+
+	// stream doesn't wait
+	other, err := client.OpenStream(ctx, "test.chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Recv(&rsp); err == nil || err.(*CallError).Code != ErrCodeOverload {
+		t.Fatalf("expect overload, got %v", err)
+	}
+
+	stream.CloseSend()
+	if err := stream.Recv(&rsp); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+	if waiting = <-waiting.Done; waiting.Error != nil {
+		t.Fatal(waiting.Error)
+	}
+}
+
+func TestSerialDispatch(t *testing.T) {
+	_, client, impl := newTestPair(t, func(server *Server) {
+		if err := server.SetSerial("test.strobe"); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetSerial("unknown"); err == nil {
+			t.Fatal("set serial on unknown module should fail")
+		}
+	}, nil)
+	defer client.Close()
+
+	for i := 0; i < 100; i++ {
+		client.MustInvoke("test.strobe", &proto_test.Strobe{Msg: proto.String(strconv.Itoa(i))})
+	}
+	for i := 0; i < 100; i++ {
+		if msg := <-impl.strobe; msg != strconv.Itoa(i) {
+			t.Fatalf("strobe out of order: expect %d, got %s", i, msg)
+		}
+	}
+
+	// key of module scope doesn't collide with scope of a method
+	rpc := NewRpc(NewBridge(testDescriptors))
+	rpc.SetSerial("test.strobe")
+	rpc.SetSerialByKey("test", func(argv interface{}) string { return "strobe" })
+	byKey, _ := rpc.orderKey(&testDescriptors[0], &proto_test.Echo{})
+	serial, _ := rpc.orderKey(&testDescriptors[1], &proto_test.Strobe{})
+	if byKey == serial {
+		t.Fatalf("order keys collide: %q", byKey)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	principals := make(chan *Principal, 1)
+	_, client, _ := newTestPair(t, func(server *Server) {
+		server.Authenticator = HMACAuthenticator(func(name string) ([]byte, *Principal, error) {
+			return []byte("secret of " + name), &Principal{Name: name, Roles: []string{"player"}}, nil
+		})
+		server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			principals <- c.Principal()
+			return handler(c, argv, reply)
+		})
+	}, nil)
+	defer client.Close()
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr.Code != ErrCodeUnauthenticated {
+		t.Fatalf("expect unauthenticated, got %v", callErr)
+	}
+
+	ctx := context.Background()
+	if err := client.Authenticate(ctx, HMACCredentials("alice", []byte("wrong"))); err == nil {
+		t.Fatal("authenticate with wrong secret should fail")
+	}
+	if err := client.Authenticate(ctx, HMACCredentials("alice", []byte("secret of alice"))); err != nil {
+		t.Fatal(err)
+	}
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if p := <-principals; p.Name != "alice" || !p.HasRole("player") {
+		t.Fatalf("unexpected principal: %+v", p)
+	}
+}
+
+// reply of a given up handshake is not taken by next one
+func TestAuthenticateAfterTimeout(t *testing.T) {
+	_, client, _ := newTestPair(t, func(server *Server) {
+		server.Authenticator = TokenAuthenticator(func(token string) (*Principal, error) {
+			if token == "slow" {
+				time.Sleep(100 * time.Millisecond)
+				return &Principal{Name: token}, nil
+			}
+			return nil, ErrAuthFailed
+		})
+	}, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.Authenticate(ctx, TokenCredentials("slow")); err == nil || !err.(*CallError).IsTimeout() {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if err := client.Authenticate(context.Background(), TokenCredentials("bad")); err == nil {
+		t.Fatal("authenticate with bad token should fail")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	c := NewContext(nil, nil)
+	c.SetAuthenticator(TokenAuthenticator(func(token string) (*Principal, error) {
+		return nil, ErrAuthFailed
+	}))
+
+	public := &Descriptor{NormalName: "debug.ping", Public: true}
+	member := &Descriptor{NormalName: "test.echo"}
+	admin := &Descriptor{NormalName: "test.kick", Roles: []string{"admin", "gm"}}
+
+	if err := c.authorize(public); err != nil {
+		t.Fatalf("public method denied: %v", err)
+	}
+	if err := c.authorize(member); err == nil || err.Code != ErrCodeUnauthenticated {
+		t.Fatalf("expect unauthenticated, got %v", err)
+	}
+
+	c.principal.Store(&Principal{Name: "alice", Roles: []string{"player"}})
+	if err := c.authorize(member); err != nil {
+		t.Fatalf("authenticated call denied: %v", err)
+	}
+	if err := c.authorize(admin); err == nil || err.Code != ErrCodePermissionDenied {
+		t.Fatalf("expect permission denied, got %v", err)
+	}
+
+	c.principal.Store(&Principal{Name: "bob", Roles: []string{"gm"}})
+	if err := c.authorize(admin); err != nil {
+		t.Fatalf("gm call denied: %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	received := make(chan Metadata, 2)
+	_, client, impl := newTestPair(t, func(server *Server) {
+		server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			received <- c.Metadata()
+			c.SetReplyMetadata("server", "daisy")
+			return handler(c, argv, reply)
+		})
+	}, nil)
+	defer client.Close()
+
+	ctx := WithMetadata(context.Background(), Metadata{"trace-id": "42"})
+	ctx = WithMetadata(ctx, Metadata{"locale": "zh_CN"})
+	var rsp proto_test.Echo_Response
+	call, err := client.GoContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call = <-call.Done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if md := <-received; md.Get("trace-id") != "42" || md.Get("locale") != "zh_CN" {
+		t.Fatalf("unexpected request metadata: %v", md)
+	}
+	if call.ReplyMetadata.Get("server") != "daisy" {
+		t.Fatalf("unexpected reply metadata: %v", call.ReplyMetadata)
+	}
+
+	if err := client.InvokeContext(ctx, "test.strobe", &proto_test.Strobe{Msg: proto.String("tick")}); err != nil {
+		t.Fatal(err)
+	}
+	<-impl.strobe
+	if md := <-received; md.Get("trace-id") != "42" {
+		t.Fatalf("unexpected invoke metadata: %v", md)
+	}
+
+	// requests without metadata still work
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if md := <-received; md != nil {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+}
+
+func TestStream(t *testing.T) {
+	_, client, impl := newTestPair(t, nil, func(client *Client) {
+		if err := client.SetFraming(FramingVarint); err != nil {
+			t.Fatal(err)
+		}
+		client.SetStreamWindow(2)
+	})
+	defer client.Close()
+
+	ctx := context.Background()
+	if _, err := client.OpenStream(ctx, "test.echo"); err == nil {
+		t.Fatal("open stream of unary method should fail")
+	}
+	var rsp proto_test.Echo_Response
+	if _, err := client.Call("test.chat", &proto_test.Echo{Req: proto.String("hello")}, &rsp); err == nil {
+		t.Fatal("call stream method should fail")
+	}
+
+	// bidi
+	stream, err := client.OpenStream(ctx, "test.chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := stream.Send(&proto_test.Echo{Req: proto.String(msg)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Recv(&rsp); err != nil || rsp.GetResp() != msg {
+			t.Fatalf("unexpected chat response: %q, %v", rsp.GetResp(), err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Recv(&rsp); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+
+	// handler error ends stream
+	stream, err = client.OpenStream(ctx, "test.chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&proto_test.Echo{Req: proto.String("fail")})
+	if err := stream.Recv(&rsp); err == nil || err.(*CallError).Code != 7 {
+		t.Fatalf("expect chat failed, got %v", err)
+	}
+
+	// slow consumer blocks sender by window
+	stream, err = client.OpenStream(ctx, "test.count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&proto_test.Echo{Req: proto.String("20")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&proto_test.Echo{Req: proto.String("20")}); err == nil {
+		t.Fatal("server stream should accept only one message")
+	}
+	// sender has no credit when window is full
+	waitFor(t, "window is full", func() bool {
+		return atomic.LoadInt32(&impl.counted) >= 2 && len(stream.recvq) == cap(stream.recvq)
+	})
+	if n := atomic.LoadInt32(&impl.counted); n != 2 {
+		t.Fatalf("sender should be blocked by window, sent %d", n)
+	}
+	for i := 0; i < 20; i++ {
+		if err := stream.Recv(&rsp); err != nil || rsp.GetResp() != strconv.Itoa(i) {
+			t.Fatalf("unexpected count %d: %q, %v", i, rsp.GetResp(), err)
+		}
+	}
+	if err := stream.Recv(&rsp); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	_, client, _ := newTestPair(t, nil, func(client *Client) {
+		if err := client.SetFraming(FramingVarint); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.OpenStream(ctx, "test.chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	var rsp proto_test.Echo_Response
+	if err := stream.Recv(&rsp); err == nil || !err.(*CallError).IsCanceled() {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+
+	stream, err = client.OpenStream(context.Background(), "test.chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := stream.Recv(&rsp); err == nil {
+		t.Fatal("stream should fail when connection is down")
+	}
+}
+
+func listenTestServer(t *testing.T, addr string) (*Server, string) {
+	server := NewBridge(testDescriptors).NewServer()
+	impl := &Test{strobe: make(chan string, 16), release: make(chan struct{}), canceled: make(chan error, 1)}
+	if err := server.RegisterModule(impl); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	return server, l.Addr().String()
+}
+
+func TestReconnectClient(t *testing.T) {
+	server, addr := listenTestServer(t, "127.0.0.1:0")
+
+	states := make(chan ConnState, 16)
+	rc := NewBridge(testDescriptors).NewReconnectClient("tcp", addr)
+	rc.MinBackoff = 10 * time.Millisecond
+	rc.MaxBackoff = 50 * time.Millisecond
+	rc.OnStateChange = func(state ConnState) {
+		states <- state
+	}
+	impl := &Test{strobe: make(chan string, 16)}
+	if err := rc.RegisterModule(impl); err != nil {
+		t.Fatal(err)
+	}
+	rc.Start()
+	defer rc.Close()
+
+	waitState := func(want ConnState) {
+		for {
+			select {
+			case state := <-states:
+				if state == want {
+					return
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("wait state %s timeout", want)
+			}
+		}
+	}
+
+	waitState(StateConnected)
+	var rsp proto_test.Echo_Response
+	if callErr := rc.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+
+	server.Close()
+	waitState(StateDisconnected)
+	if callErr := rc.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr == nil || callErr.Code != ErrCodeUnavailable {
+		t.Fatalf("expect unavailable, got %v", callErr)
+	}
+
+	// modules are registered on the new connection too
+	server, _ = listenTestServer(t, addr)
+	defer server.Close()
+	waitState(StateConnected)
+	for server.NumContexts() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := server.Broadcast("test.strobe", &proto_test.Strobe{Msg: proto.String("back")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-impl.strobe; msg != "back" {
+		t.Fatalf("unexpected strobe: %s", msg)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	// peer accepts and drops connections at once
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := int32(0)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	rc := NewBridge(testDescriptors).NewReconnectClient("tcp", l.Addr().String())
+	rc.MinBackoff = 20 * time.Millisecond
+	rc.MaxBackoff = time.Second
+	rc.Start()
+	time.Sleep(500 * time.Millisecond)
+	rc.Close()
+
+	// delays are about 10+20+40+80+160ms with jitter
+	if n := atomic.LoadInt32(&accepted); n > 10 {
+		t.Fatalf("%d connections in 500ms", n)
+	}
+}
+
+func TestReconnectBackoffReset(t *testing.T) {
+	// peer drops connections after they stay up longer than MaxBackoff
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			time.AfterFunc(100*time.Millisecond, func() { conn.Close() })
+		}
+	}()
+
+	var mu sync.Mutex
+	var down time.Time
+	var delays []time.Duration
+	rc := NewBridge(testDescriptors).NewReconnectClient("tcp", l.Addr().String())
+	rc.MinBackoff = 10 * time.Millisecond
+	rc.MaxBackoff = 50 * time.Millisecond
+	rc.OnStateChange = func(state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case StateDisconnected:
+			down = time.Now()
+		case StateConnecting:
+			if !down.IsZero() {
+				delays = append(delays, time.Since(down))
+			}
+		}
+	}
+	rc.Start()
+	time.Sleep(600 * time.Millisecond)
+	rc.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delays) < 3 {
+		t.Fatalf("only %d reconnects", len(delays))
+	}
+	// backoff starts over after every long connection, it never grows to MaxBackoff
+	for i, d := range delays {
+		if d >= 25*time.Millisecond {
+			t.Fatalf("delay %d is %v, backoff is not reset", i, d)
+		}
+	}
+}
+
+func TestReconnectClientQueue(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	rc := NewBridge(testDescriptors).NewReconnectClient("tcp", addr)
+	rc.MinBackoff = 10 * time.Millisecond
+	rc.MaxBackoff = 20 * time.Millisecond
+	rc.QueueWhileDisconnected = true
+	rc.Setup = func(client *Client) error {
+		return client.SetFraming(FramingVarint)
+	}
+	rc.Start()
+	defer rc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	var rsp proto_test.Echo_Response
+	if callErr, _ := rc.CallContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); !callErr.IsTimeout() {
+		t.Fatalf("expect timeout, got %v", callErr)
+	}
+
+	done := make(chan *CallError, 1)
+	go func() {
+		done <- rc.MustCall("test.echo", &proto_test.Echo{Req: proto.String("queued")}, &rsp)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	server, _ := listenTestServer(t, addr)
+	defer server.Close()
+	if callErr := <-done; callErr != nil || rsp.GetResp() != "queued" {
+		t.Fatalf("queued call failed: %v", callErr)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	server, client, _ := newTestPair(t, func(server *Server) {
+		server.ReadTimeout = 100 * time.Millisecond
+	}, func(client *Client) {
+		if err := client.SetFraming(FramingVarint); err != nil {
+			t.Fatal(err)
+		}
+		client.SetKeepalive(20 * time.Millisecond)
+	})
+	defer client.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("alive")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+
+	// heartbeats don't keep an idle client
+	for _, c := range server.snapshot() {
+		c.SetIdleTimeout(100 * time.Millisecond)
+	}
+	waitFor(t, "idle client is evicted", func() bool { return server.NumContexts() == 0 })
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("evicted")}, &rsp); callErr == nil {
+		t.Fatal("call on evicted connection should fail")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	// peer accepts but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	client, err := NewBridge(testDescriptors).Dail("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadTimeout(100 * time.Millisecond)
+	go client.Serve()
+	defer client.Close()
+
+	start := time.Now()
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr == nil {
+		t.Fatal("call to dead peer should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("dead peer detected too late: %v", elapsed)
+	}
+}
+
+// servers count requests they handled
+func listenCountingServers(t *testing.T, n int) ([]*Server, []string, []int32) {
+	servers := make([]*Server, n)
+	addrs := make([]string, n)
+	counts := make([]int32, n)
+	for i := range servers {
+		i := i
+		servers[i], addrs[i] = listenTestServer(t, "127.0.0.1:0")
+		servers[i].Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			atomic.AddInt32(&counts[i], 1)
+			return handler(c, argv, reply)
+		})
+	}
+	return servers, addrs, counts
+}
+
+// poll until cond is true
+func waitFor(t testing.TB, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait %s timeout", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// requests running on all contexts of server
+func serverInFlight(server *Server) int {
+	n := 0
+	for _, context := range server.snapshot() {
+		n += context.InFlight()
+	}
+	return n
+}
+
+func waitHealthy(t *testing.T, pool *Pool, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		healthy := 0
+		for _, b := range pool.Backends() {
+			if b.Healthy() {
+				healthy++
+			}
+		}
+		if healthy == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wait %d healthy backends timeout, %d now", n, healthy)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolBalancers(t *testing.T) {
+	servers, addrs, counts := listenCountingServers(t, 3)
+	for _, server := range servers {
+		defer server.Close()
+	}
+
+	echo := func(pool *Pool, req string) {
+		var rsp proto_test.Echo_Response
+		if callErr := pool.MustCall("test.echo", &proto_test.Echo{Req: proto.String(req)}, &rsp); callErr != nil {
+			t.Fatal(callErr)
+		}
+	}
+	reset := func() {
+		for i := range counts {
+			atomic.StoreInt32(&counts[i], 0)
+		}
+	}
+
+	pool := NewBridge(testDescriptors).NewPool("tcp", addrs)
+	pool.Start()
+	defer pool.Close()
+	waitHealthy(t, pool, 3)
+	for i := 0; i < 30; i++ {
+		echo(pool, "hello")
+	}
+	for i := range counts {
+		if n := atomic.LoadInt32(&counts[i]); n != 10 {
+			t.Fatalf("round robin: server %d handled %d", i, n)
+		}
+	}
+
+	reset()
+	hashed := NewBridge(testDescriptors).NewPool("tcp", addrs)
+	hashed.Balancer = ConsistentHash(func(method string, argv interface{}) string {
+		return argv.(*proto_test.Echo).GetReq()
+	})
+	hashed.Start()
+	defer hashed.Close()
+	waitHealthy(t, hashed, 3)
+	for i := 0; i < 10; i++ {
+		echo(hashed, "player-1")
+	}
+	hits := 0
+	for i := range counts {
+		if n := atomic.LoadInt32(&counts[i]); n == 10 {
+			hits++
+		} else if n != 0 {
+			t.Fatalf("consistent hash: server %d handled %d", i, n)
+		}
+	}
+	if hits != 1 {
+		t.Fatal("consistent hash: requests of a key should go to one server")
+	}
+
+	reset()
+	least := NewBridge(testDescriptors).NewPool("tcp", addrs[:2])
+	least.Balancer = LeastPending()
+	least.Start()
+	defer least.Close()
+	waitHealthy(t, least, 2)
+	blocked := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		var rsp proto_test.Echo_Response
+		close(blocked)
+		least.CallContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("wait")}, &rsp)
+	}()
+	<-blocked
+	time.Sleep(50 * time.Millisecond)
+	before := []int32{atomic.LoadInt32(&counts[0]), atomic.LoadInt32(&counts[1])}
+	for i := 0; i < 10; i++ {
+		echo(least, "hello")
+	}
+	// all go to the backend which is not busy
+	if d0, d1 := atomic.LoadInt32(&counts[0])-before[0], atomic.LoadInt32(&counts[1])-before[1]; d0*d1 != 0 || d0+d1 != 10 {
+		t.Fatalf("least pending: unexpected distribution %d %d", d0, d1)
+	}
+}
+
+func TestPoolEject(t *testing.T) {
+	servers, addrs, counts := listenCountingServers(t, 2)
+	defer servers[0].Close()
+
+	pool := NewBridge(testDescriptors).NewPool("tcp", addrs)
+	pool.MinBackoff = 10 * time.Millisecond
+	pool.MaxBackoff = 20 * time.Millisecond
+	pool.HealthCheckInterval = 20 * time.Millisecond
+	unhealthy := int32(0)
+	pool.HealthCheck = func(ctx context.Context, client *Client) error {
+		if atomic.LoadInt32(&unhealthy) != 0 && client.RemoteAddr().String() == addrs[0] {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}
+	pool.Start()
+	defer pool.Close()
+	waitHealthy(t, pool, 2)
+
+	// backend down
+	servers[1].Close()
+	waitHealthy(t, pool, 1)
+	var rsp proto_test.Echo_Response
+	for i := 0; i < 10; i++ {
+		if callErr := pool.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+			t.Fatal(callErr)
+		}
+	}
+
+	// backend comes back
+	servers[1], _ = listenTestServer(t, addrs[1])
+	defer servers[1].Close()
+	waitHealthy(t, pool, 2)
+
+	// failing health check ejects backend
+	atomic.StoreInt32(&unhealthy, 1)
+	waitHealthy(t, pool, 1)
+	before := atomic.LoadInt32(&counts[0])
+	for i := 0; i < 10; i++ {
+		if callErr := pool.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+			t.Fatal(callErr)
+		}
+	}
+	if n := atomic.LoadInt32(&counts[0]); n != before {
+		t.Fatalf("ejected backend handled %d requests", n-before)
+	}
+	atomic.StoreInt32(&unhealthy, 0)
+	waitHealthy(t, pool, 2)
+
+	// canceled calls don't reset failures
+	b := pool.Backends()[0]
+	atomic.StoreInt32(&b.failures, 1)
+	pool.record(b, contextCallError(context.Canceled))
+	if n := atomic.LoadInt32(&b.failures); n != 1 {
+		t.Fatalf("failures is %d after canceled call", n)
+	}
+	pool.record(b, nil)
+	if n := atomic.LoadInt32(&b.failures); n != 0 {
+		t.Fatalf("failures is %d after success", n)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	attempts := int32(0)
+	server, client, _ := newTestPair(t, func(server *Server) {
+		server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			// every third attempt succeeds
+			if atomic.AddInt32(&attempts, 1)%3 != 0 {
+				return NewCallError(ErrCodeOverload, "try again")
+			}
+			return handler(c, argv, reply)
+		})
+	}, nil)
+	defer server.Close()
+	defer client.Close()
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr == nil || callErr.Code != ErrCodeOverload {
+		t.Fatalf("call without retry policy: %v", callErr)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	if err := client.SetRetryPolicy("test", &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if rsp.GetResp() != "hello" || atomic.LoadInt32(&attempts) != 3 {
+		t.Fatalf("unexpected reply %q after %d attempts", rsp.GetResp(), attempts)
+	}
+
+	// method setting overrides module setting
+	atomic.StoreInt32(&attempts, 0)
+	if err := client.SetRetryPolicy("test.echo", &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr == nil || atomic.LoadInt32(&attempts) != 2 {
+		t.Fatalf("expect failure after 2 attempts, got %v after %d", callErr, attempts)
+	}
+
+	if err := client.SetRetryPolicy("unknown", nil); err == nil {
+		t.Fatal("expect error of unknown name")
+	}
+
+	// idempotent methods use default policy unless disabled
+	dptor := testDescriptors[0]
+	dptor.NormalName = "test.idempotent"
+	dptor.Idempotent = true
+	bridge := NewBridge(testDescriptors)
+	rpc := NewRpc(bridge)
+	if policy := rpc.retryPolicy(&dptor); policy != &DefaultRetryPolicy {
+		t.Fatalf("idempotent method should use default policy, got %v", policy)
+	}
+	rpc.SetRetryPolicy("test", nil)
+	if policy := rpc.retryPolicy(&dptor); policy != nil {
+		t.Fatalf("retry should be disabled, got %v", policy)
+	}
+
+	// unavailable call may be sent already, it's retried by default only if idempotent
+	unavailable := NewCallError(ErrCodeUnavailable, "connection down")
+	if DefaultRetryPolicy.retryable(&testDescriptors[0], unavailable) || !DefaultRetryPolicy.retryable(&dptor, unavailable) {
+		t.Fatal("unavailable should be retried only for idempotent method")
+	}
+}
+
+func TestPoolHedge(t *testing.T) {
+	servers, addrs, counts := listenCountingServers(t, 2)
+	for _, server := range servers {
+		defer server.Close()
+	}
+	// first server is slow
+	servers[0].Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+		select {
+		case <-time.After(time.Second):
+		case <-c.Done():
+			return contextCallError(c.Err())
+		}
+		return handler(c, argv, reply)
+	})
+
+	// only idempotent methods are hedged
+	hedge := &HedgePolicy{MaxAttempts: 2, Delay: 20 * time.Millisecond}
+	if err := NewBridge(testDescriptors).NewPool("tcp", addrs).SetHedgePolicy("test.echo", hedge); err == nil {
+		t.Fatal("expect error of hedging non-idempotent method")
+	}
+	dptors := append([]Descriptor(nil), testDescriptors...)
+	dptors[0].Idempotent = true
+
+	pool := NewBridge(dptors).NewPool("tcp", addrs)
+	pool.Start()
+	defer pool.Close()
+	waitHealthy(t, pool, 2)
+	if err := pool.SetHedgePolicy("test.echo", hedge); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		var rsp proto_test.Echo_Response
+		req := "hello" + strconv.Itoa(i)
+		if callErr := pool.MustCall("test.echo", &proto_test.Echo{Req: proto.String(req)}, &rsp); callErr != nil {
+			t.Fatal(callErr)
+		}
+		if rsp.GetResp() != req {
+			t.Fatalf("unexpected reply: %s", rsp.GetResp())
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("hedged call took %v", elapsed)
+		}
+	}
+	// round robin sends half of first attempts to the slow server
+	if n := atomic.LoadInt32(&counts[1]); n != 4 {
+		t.Fatalf("fast server handled %d requests", n)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := int32(1)
+	handled := int32(0)
+	server, client, impl := newTestPair(t, func(server *Server) {
+		server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			atomic.AddInt32(&handled, 1)
+			if atomic.LoadInt32(&failing) != 0 {
+				return NewCallError(ErrCodeOverload, "overload")
+			}
+			return handler(c, argv, reply)
+		})
+	}, nil)
+	defer server.Close()
+	defer client.Close()
+
+	var states []BreakerState
+	breaker := &CircuitBreaker{
+		MinRequests: 4,
+		OpenTimeout: 50 * time.Millisecond,
+		OnStateChange: func(key string, state BreakerState) {
+			states = append(states, state)
+		},
+	}
+	client.InterceptOutgoing(breaker.Interceptor())
+	key := client.RemoteAddr().String() + "/test.echo"
+
+	var rsp proto_test.Echo_Response
+	echo := func() *CallError {
+		return client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp)
+	}
+	for i := 0; i < 4; i++ {
+		if callErr := echo(); callErr == nil || callErr.Code != ErrCodeOverload {
+			t.Fatalf("expect overload, got %v", callErr)
+		}
+	}
+	if state := breaker.State(key); state != BreakerOpen {
+		t.Fatalf("circuit should be open, it's %s", state)
+	}
+
+	// fails fast without reaching server
+	if callErr := echo(); callErr == nil || callErr.Code != ErrCodeCircuitOpen {
+		t.Fatalf("expect circuit open, got %v", callErr)
+	}
+	if n := atomic.LoadInt32(&handled); n != 4 {
+		t.Fatalf("server handled %d requests", n)
+	}
+
+	// failed probe opens circuit again
+	time.Sleep(60 * time.Millisecond)
+	if callErr := echo(); callErr == nil || callErr.Code != ErrCodeOverload {
+		t.Fatalf("expect probe fails, got %v", callErr)
+	}
+	if state := breaker.State(key); state != BreakerOpen {
+		t.Fatalf("circuit should be open after probe fails, it's %s", state)
+	}
+
+	// successful probe closes circuit
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	if callErr := echo(); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if state := breaker.State(key); state != BreakerClosed {
+		t.Fatalf("circuit should be closed, it's %s", state)
+	}
+	expect := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if !reflect.DeepEqual(states, expect) {
+		t.Fatalf("unexpected state changes: %v", states)
+	}
+	if got := breaker.States(); len(got) != 1 || got[key] != BreakerClosed {
+		t.Fatalf("unexpected states: %v", got)
+	}
+
+	// timeouts trip circuit of their own rate
+	timeouts := &CircuitBreaker{MinRequests: 2, TimeoutRate: 0.5, ErrorRate: 1}
+	client.InterceptOutgoing(timeouts.Interceptor())
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		client.CallContext(ctx, "test.echo", &proto_test.Echo{Req: proto.String("wait")}, &rsp)
+		cancel()
+		<-impl.canceled
+	}
+	if state := timeouts.State(key); state != BreakerOpen {
+		t.Fatalf("circuit should be open after timeouts, it's %s", state)
+	}
+}
+
+type testServer interface {
+	Echo(c *Context, req *proto_test.Echo, rsp *proto_test.Echo_Response) *CallError
+	Strobe(c *Context, req *proto_test.Strobe)
+}
+
+// type name differs from module, extra methods are not services
+type renamedTest struct {
+	Test
+}
+
+func (r *renamedTest) Helper() {}
+
+func TestRegisterService(t *testing.T) {
+	iface := reflect.TypeOf((*testServer)(nil)).Elem()
+	impl := &renamedTest{Test{release: make(chan struct{})}}
+
+	bridge := NewBridge(testDescriptors)
+	server := bridge.NewServer()
+	if err := server.RegisterModule(impl); err == nil {
+		t.Fatal("RegisterModule should reject type named renamedTest")
+	}
+	if err := server.RegisterService("Test", reflect.TypeOf(impl), impl); err == nil {
+		t.Fatal("expect error of non-interface type")
+	}
+	if err := server.RegisterService("Test", iface, new(int)); err == nil {
+		t.Fatal("expect error of receiver not implementing interface")
+	}
+	if err := server.RegisterService("Test", iface, impl); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RegisterService("Test", iface, impl); err == nil {
+		t.Fatal("expect error of repeated registration")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	defer server.Close()
+
+	client, err := bridge.Dail("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Serve()
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if rsp.GetResp() != "hello" {
+		t.Fatalf("unexpected reply: %s", rsp.GetResp())
+	}
+}
+
+// testDescriptors with dispatch functions like generated ones, handled counts their calls
+func generatedDescriptors(handled *int32) []Descriptor {
+	dptors := make([]Descriptor, len(testDescriptors))
+	copy(dptors, testDescriptors)
+	dptors[0].NewArgs = func() (argv, reply interface{}) {
+		return new(proto_test.Echo), new(proto_test.Echo_Response)
+	}
+	dptors[0].Handler = func(rcvr interface{}, c *Context, argv, reply interface{}) *CallError {
+		atomic.AddInt32(handled, 1)
+		return rcvr.(interface {
+			Echo(*Context, *proto_test.Echo, *proto_test.Echo_Response) *CallError
+		}).Echo(c, argv.(*proto_test.Echo), reply.(*proto_test.Echo_Response))
+	}
+	dptors[1].NewArgs = func() (argv, reply interface{}) {
+		return new(proto_test.Strobe), nil
+	}
+	dptors[1].Handler = func(rcvr interface{}, c *Context, argv, reply interface{}) *CallError {
+		atomic.AddInt32(handled, 1)
+		rcvr.(interface {
+			Strobe(*Context, *proto_test.Strobe)
+		}).Strobe(c, argv.(*proto_test.Strobe))
+		return nil
+	}
+	dptors[2].Handler = func(rcvr interface{}, c *Context, argv, reply interface{}) *CallError {
+		atomic.AddInt32(handled, 1)
+		return rcvr.(interface {
+			Chat(*Context, *Stream) *CallError
+		}).Chat(c, argv.(*Stream))
+	}
+	return dptors
+}
+
+func TestGeneratedDispatch(t *testing.T) {
+	handled := int32(0)
+	bridge := NewBridge(generatedDescriptors(&handled))
+	server := bridge.NewServer()
+	impl := &Test{strobe: make(chan string, 1)}
+	if err := server.RegisterModule(impl); err != nil {
+		t.Fatal(err)
+	}
+	intercepted := int32(0)
+	server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+		atomic.AddInt32(&intercepted, 1)
+		return handler(c, argv, reply)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	defer server.Close()
+
+	client, err := bridge.Dail("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// streams need negotiated framing
+	if err := client.SetFraming(FramingVarint); err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if rsp.GetResp() != "hello" {
+		t.Fatalf("unexpected reply: %s", rsp.GetResp())
+	}
+	client.MustInvoke("test.strobe", &proto_test.Strobe{Msg: proto.String("strobe")})
+	if msg := <-impl.strobe; msg != "strobe" {
+		t.Fatalf("unexpected strobe: %s", msg)
+	}
+
+	st, err := client.OpenStream(context.Background(), "test.chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Send(&proto_test.Echo{Req: proto.String("chat")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Recv(&rsp); err != nil || rsp.GetResp() != "chat" {
+		t.Fatalf("unexpected stream reply %q: %v", rsp.GetResp(), err)
+	}
+	st.CloseSend()
+	if err := st.Recv(&rsp); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+
+	// count method is not generated and falls back to reflection
+	if n := atomic.LoadInt32(&handled); n != 3 {
+		t.Fatalf("generated handlers handled %d requests", n)
+	}
+	if n := atomic.LoadInt32(&intercepted); n != 3 {
+		t.Fatalf("interceptor saw %d requests", n)
+	}
+}
+
+// allocate, unmarshal and handle a request, as dispatchRequest does
+func benchmarkDispatch(b *testing.B, dptors []Descriptor) {
+	rpc := NewRpc(NewBridge(dptors))
+	if err := rpc.RegisterModule(new(Test)); err != nil {
+		b.Fatal(err)
+	}
+	s := rpc.getService(100001)
+	data, _ := proto.Marshal(&proto_test.Echo{Req: proto.String("hello")})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		argv, reply := s.newArgs()
+		if err := proto.Unmarshal(data, argv.(proto.Message)); err != nil {
+			b.Fatal(err)
+		}
+		if callErr := rpc.handle(nil, s, argv, reply); callErr != nil {
+			b.Fatal(callErr)
+		}
+	}
+}
+
+func BenchmarkDispatchReflect(b *testing.B) {
+	benchmarkDispatch(b, testDescriptors)
+}
+
+func BenchmarkDispatchGenerated(b *testing.B) {
+	handled := int32(0)
+	benchmarkDispatch(b, generatedDescriptors(&handled))
+}
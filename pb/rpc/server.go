@@ -1,19 +1,69 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xjdrew/daisy/gen/proto/base"
 )
 
+// returned by Accept after Shutdown or Close
+var ErrServerClosed = errors.New("rpc: Server closed")
+
+// interval of checking running requests in Shutdown
+const shutdownPollInterval = 10 * time.Millisecond
+
 type Server struct {
 	Rpc
+
+	// max frame size of accepted connections, DefaultMaxFrameSize if zero
+	MaxFrameSize int
+	// max size of reassembled chunked message, DefaultMaxMessageSize if zero
+	MaxMessageSize int
+	// max size of partial messages of a connection, DefaultMaxPendingSize if zero
+	MaxPendingSize int
+	// write queue of accepted connections, DefaultWriteQueueSize if zero
+	WriteQueueSize   int
+	WriteQueuePolicy QueuePolicy
+	// limits of running requests of server and of each connection, 0 means unlimited
+	MaxInFlight        int
+	MaxInFlightPerConn int
+	// requests wait when a limit is hit, instead of being rejected
+	PauseOnOverload bool
+	// if not nil, clients must authenticate before calling services
+	Authenticator Authenticator
+	// heartbeat and timeouts of accepted connections, 0 means disabled
+	KeepaliveInterval time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration // evict clients which send no request in IdleTimeout
+	// max time of TLS handshake, ReadTimeout if zero, DefaultHandshakeTimeout if both are zero
+	HandshakeTimeout time.Duration
+
+	smu        sync.Mutex
+	listeners  map[net.Listener]struct{}
+	contexts   map[uint64]*Context
+	lastId     uint64
+	groups     map[string]map[uint64]*Context // group -> members
+	joined     map[uint64]map[string]bool     // context -> groups
+	inShutdown int32
+
+	slots     semaphore
+	slotsOnce sync.Once
 }
 
 func newServer(bridge *Bridge) *Server {
 	return &Server{
-		Rpc: Rpc{bridge: bridge, serviceMap: make(map[int32]*service)},
+		Rpc:       Rpc{bridge: bridge, serviceMap: make(map[int32]*service)},
+		listeners: make(map[net.Listener]struct{}),
+		contexts:  make(map[uint64]*Context),
+		groups:    make(map[string]map[uint64]*Context),
+		joined:    make(map[uint64]map[string]bool),
 	}
 }
 
@@ -27,10 +77,80 @@ func (r *Rpc) onUnknownPack(context *Context, pack *proto_base.Pack) bool {
 	return false
 }
 
+func (r *Rpc) onClose(context *Context) {
+}
+
+func (server *Server) onClose(context *Context) {
+	server.smu.Lock()
+	id := context.Id()
+	delete(server.contexts, id)
+	for group := range server.joined[id] {
+		server.leave(group, id)
+	}
+	server.smu.Unlock()
+}
+
+func (server *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&server.inShutdown) != 0
+}
+
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.smu.Lock()
+	defer server.smu.Unlock()
+	if add {
+		if server.shuttingDown() {
+			return false
+		}
+		server.listeners[lis] = struct{}{}
+	} else {
+		delete(server.listeners, lis)
+	}
+	return true
+}
+
+func (server *Server) newContext(conn net.Conn) *Context {
+	context := NewContext(server, conn)
+	context.SetMaxFrameSize(server.MaxFrameSize)
+	context.SetMaxMessageSize(server.MaxMessageSize)
+	context.SetMaxPendingSize(server.MaxPendingSize)
+	context.SetWriteQueue(server.WriteQueueSize, server.WriteQueuePolicy)
+	context.SetMaxInFlight(server.MaxInFlightPerConn, server.PauseOnOverload)
+	context.SetAuthenticator(server.Authenticator)
+	context.SetReadTimeout(server.ReadTimeout)
+	context.SetWriteTimeout(server.WriteTimeout)
+	context.SetHandshakeTimeout(server.HandshakeTimeout)
+	if server.KeepaliveInterval > 0 {
+		context.SetKeepalive(server.KeepaliveInterval)
+	}
+	if server.IdleTimeout > 0 {
+		context.SetIdleTimeout(server.IdleTimeout)
+	}
+
+	server.smu.Lock()
+	if server.shuttingDown() {
+		server.smu.Unlock()
+		context.Close()
+		return nil
+	}
+	server.lastId++
+	context.id = server.lastId
+	server.contexts[context.id] = context
+	server.smu.Unlock()
+	return context
+}
+
 func (server *Server) Accept(lis net.Listener) error {
+	if !server.trackListener(lis, true) {
+		return ErrServerClosed
+	}
+	defer server.trackListener(lis, false)
+
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
 			if opErr, ok := err.(*net.OpError); ok {
 				if !opErr.Temporary() {
 					return err
@@ -39,7 +159,70 @@ func (server *Server) Accept(lis net.Listener) error {
 			continue
 		}
 
-		context := NewContext(server, conn)
+		context := server.newContext(conn)
+		if context == nil {
+			return ErrServerClosed
+		}
 		go context.serve()
 	}
 }
+
+// stop listeners, return all live contexts
+func (server *Server) stop() []*Context {
+	server.smu.Lock()
+	atomic.StoreInt32(&server.inShutdown, 1)
+	for lis := range server.listeners {
+		lis.Close()
+		delete(server.listeners, lis)
+	}
+	server.smu.Unlock()
+	return server.snapshot()
+}
+
+/*
+	gracefully shut down the server
+	stop accepting, tell peers the server is going away, wait running requests
+	to finish and close all connections. if ctx is done before requests finish,
+	connections are closed anyway and ctx's error is returned
+*/
+func (server *Server) Shutdown(ctx context.Context) error {
+	contexts := server.stop()
+	for _, context := range contexts {
+		context.goAway()
+	}
+
+	defer func() {
+		for _, context := range contexts {
+			context.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		idle := true
+		for _, context := range contexts {
+			if context.InFlight() > 0 {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// close listeners and all connections immediately
+func (server *Server) Close() error {
+	for _, context := range server.stop() {
+		context.Close()
+	}
+	return nil
+}
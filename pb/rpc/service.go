@@ -5,15 +5,44 @@ import (
 )
 
 type service struct {
-	rcvr   reflect.Value
-	method reflect.Method
-	dptor  *Descriptor
+	rcvr     reflect.Value
+	receiver interface{} // rcvr.Interface(), passed to generated handler
+	method   reflect.Method
+	dptor    *Descriptor
 }
 
 func (s *service) hasReply() bool {
 	return s.dptor.HasReply()
 }
 
+// reply is nil if method has not a reply
+func (s *service) newArgs() (argv, reply interface{}) {
+	if s.dptor.NewArgs != nil {
+		return s.dptor.NewArgs()
+	}
+	argv = reflect.New(s.dptor.ArgType.Elem()).Interface()
+	if s.hasReply() {
+		reply = reflect.New(s.dptor.ReplyType.Elem()).Interface()
+	}
+	return
+}
+
+func (s *service) handle(c *Context, argv, reply interface{}) *CallError {
+	if s.dptor.Handler != nil {
+		return s.dptor.Handler(s.receiver, c, argv, reply)
+	}
+
+	argvv := reflect.ValueOf(argv)
+	if s.dptor.IsStream() {
+		return s.stream(c, argvv)
+	}
+	if s.hasReply() {
+		return s.call(c, argvv, reflect.ValueOf(reply))
+	}
+	s.invoke(c, argvv)
+	return nil
+}
+
 // have response
 func (s *service) call(c *Context, argv, replyv reflect.Value) *CallError {
 	function := s.method.Func
@@ -31,3 +60,15 @@ func (s *service) invoke(c *Context, argv reflect.Value) {
 	function := s.method.Func
 	function.Call([]reflect.Value{s.rcvr, reflect.ValueOf(c), argv})
 }
+
+// argv is the *Stream
+func (s *service) stream(c *Context, argv reflect.Value) *CallError {
+	function := s.method.Func
+	returnValues := function.Call([]reflect.Value{s.rcvr, reflect.ValueOf(c), argv})
+
+	inter := returnValues[0].Interface()
+	if inter == nil {
+		return nil
+	}
+	return inter.(*CallError)
+}
@@ -0,0 +1,481 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/base"
+)
+
+/*
+	streaming methods
+	opener sends a pack typed with service id to open a stream on a new session,
+	then messages of both sides are sent as stream frames on the session.
+	opener closes its side by an end frame, acceptor ends the stream by a response
+	when the handler returns, with error if handler fails.
+
+	flow control is by messages: receiver grants credits by ack frames,
+	initially its window, then one credit for each message consumed by Recv.
+	sender blocks when it runs out of credits.
+*/
+
+const DefaultStreamWindow = 32
+
+var errStreamClosed = errors.New("stream closed")
+
+type Stream struct {
+	c       *Context
+	ctx     context.Context
+	dptor   *Descriptor
+	session int32
+	opener  bool
+
+	// receive side, recvq is buffered by window
+	recvq     chan []byte
+	recvDone  chan struct{} // peer sent all messages, or stream failed
+	recvOnce  sync.Once
+	recvErr   error
+	replyMeta Metadata
+	ackLock   sync.Mutex
+	consumed  int
+
+	// send side, chunks of messages must not interleave
+	sendLock   sync.Mutex
+	credit     int32
+	creditWake chan struct{}
+	sent       int
+	sendClosed bool
+
+	// closed when stream is over
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStream(c *Context, ctx context.Context, dptor *Descriptor, session int32, opener bool) *Stream {
+	return &Stream{
+		c:          c,
+		ctx:        ctx,
+		dptor:      dptor,
+		session:    session,
+		opener:     opener,
+		recvq:      make(chan []byte, c.streamWindow),
+		recvDone:   make(chan struct{}),
+		creditWake: make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+}
+
+// set receive window of streams opened or accepted later
+func (c *Context) SetStreamWindow(n int) {
+	if n <= 0 {
+		n = DefaultStreamWindow
+	}
+	c.streamWindow = n
+}
+
+// open a stream of a streaming method, the stream fails when ctx is done.
+// metadata attached to ctx is sent with the open frame
+func (c *Context) OpenStream(ctx context.Context, method string) (*Stream, error) {
+	dptor := c.owner.getDescriptor(method)
+	if dptor == nil {
+		return nil, fmt.Errorf("open unknown stream:%s", method)
+	}
+
+	if !dptor.IsStream() {
+		return nil, fmt.Errorf("method %s is not a stream", method)
+	}
+
+	if !c.negotiated() {
+		return nil, fmt.Errorf("open stream %s: peer does not support stream", method)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, contextCallError(err)
+	}
+
+	if atomic.LoadInt32(&c.peerLeaves) != 0 {
+		return nil, NewCallError(ErrCodeUnavailable, "peer is going away")
+	}
+
+	var pack proto_base.Pack
+	pack.Type = proto.Int32(dptor.Id)
+	pack.Meta = encodeMetadata(OutgoingMetadata(ctx))
+	pack.Timeout = packTimeout(ctx)
+
+	session := c.nextSession()
+	pack.Session = proto.Int32(session)
+	st := newStream(c, ctx, dptor, session, true)
+	c.streamLock.Lock()
+	c.outStreams[session] = st
+	c.streamLock.Unlock()
+
+	if c.endpoint.ctx.Err() != nil {
+		c.grabStream(true, session)
+		return nil, NewCallError(ErrCodeUnavailable, "connection down")
+	}
+	if err := c.writePack(&pack, frameCall); err != nil {
+		c.grabStream(true, session)
+		return nil, writeCallError(err)
+	}
+	st.writeAck(c.streamWindow)
+	if ctx.Done() != nil {
+		go st.watch()
+	}
+	return st, nil
+}
+
+// fail stream when ctx of opener is done
+func (st *Stream) watch() {
+	select {
+	case <-st.ctx.Done():
+		if st.c.grabStream(true, st.session) == st {
+			st.finish(contextCallError(st.ctx.Err()))
+			st.c.writeCancel(st.session)
+		}
+	case <-st.closed:
+	}
+}
+
+// streams opened by this side if out is true, otherwise by peer. streamLock must be held
+func (c *Context) streams(out bool) map[int32]*Stream {
+	if out {
+		return c.outStreams
+	}
+	return c.inStreams
+}
+
+func (c *Context) grabStream(out bool, session int32) *Stream {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	streams := c.streams(out)
+	st := streams[session]
+	delete(streams, session)
+	return st
+}
+
+func (c *Context) lookupStream(out bool, session int32) *Stream {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	return c.streams(out)[session]
+}
+
+// accept a stream opened by peer, handler runs in a new goroutine
+func (c *Context) acceptStream(s *service, pack *proto_base.Pack) bool {
+	// counted before draining is checked, so Shutdown never misses it
+	atomic.AddInt32(&c.inflight, 1)
+	if atomic.LoadInt32(&c.draining) != 0 {
+		atomic.AddInt32(&c.inflight, -1)
+		c.rejectRequest(s, pack, NewCallError(ErrCodeUnavailable, "server is going away"))
+		return true
+	}
+
+	// stream holds the slot until it's over, it never waits for one even in pause mode
+	if !c.takeSlot(nil) {
+		atomic.AddInt32(&c.inflight, -1)
+		c.rejectRequest(s, pack, NewCallError(ErrCodeOverload, "too many requests"))
+		return true
+	}
+
+	session := pack.GetSession()
+	context, cancel := c.withRequest(pack, true)
+	st := newStream(context, context, s.dptor, session, false)
+	c.streamLock.Lock()
+	c.inStreams[session] = st
+	c.streamLock.Unlock()
+	st.writeAck(c.streamWindow)
+
+	go func() {
+		callError := c.owner.handle(context, s, st, nil)
+		c.giveSlot()
+		c.grabStream(false, session)
+		st.close()
+		if context.Err() == nil {
+			c.writeResponse(session, nil, callError, context.replyMetadata())
+		}
+		cancel()
+		atomic.AddInt32(&c.inflight, -1)
+	}()
+	return true
+}
+
+// stream frames from peer
+func (c *Context) dispatchStream(pack *proto_base.Pack) bool {
+	session := pack.GetSession()
+	var st *Stream
+	switch pack.GetType() {
+	case typeStreamMsg, typeStreamEnd, typeStreamAck:
+		st = c.lookupStream(false, session)
+	default:
+		st = c.lookupStream(true, session)
+	}
+	if st == nil {
+		// stream is over, frames on the way are dropped
+		log.Printf("drop stream frame:%d %d", session, pack.GetType())
+		return true
+	}
+
+	switch pack.GetType() {
+	case typeStreamMsg, typeStreamReply:
+		select {
+		case st.recvq <- pack.GetData():
+		default:
+			log.Printf("stream %d: peer exceeds window", session)
+			st.abort(NewCallError(ErrCodeInternal, "stream window exceeded"))
+		}
+	case typeStreamEnd:
+		st.finishRecv(io.EOF)
+	case typeStreamAck, typeStreamReplyAck:
+		n, _ := binary.Uvarint(pack.GetData())
+		st.addCredit(int32(n))
+	}
+	return true
+}
+
+// response ends a stream opened by this side, false if no such stream
+func (c *Context) endStream(pack *proto_base.Pack) bool {
+	st := c.grabStream(true, pack.GetSession())
+	if st == nil {
+		return false
+	}
+	st.replyMeta = decodeMetadata(pack.GetMeta())
+	var err error = io.EOF
+	if packError := pack.GetError(); packError.GetFailed() {
+		err = NewRpcCallError(packError.GetCode(), packError.GetError())
+	}
+	st.finish(err)
+	return true
+}
+
+func (c *Context) closeAllStreams() {
+	c.streamLock.Lock()
+	streams := c.outStreams
+	c.outStreams = make(map[int32]*Stream)
+	c.streamLock.Unlock()
+
+	for _, st := range streams {
+		st.finish(NewCallError(ErrCodeUnavailable, "connection down"))
+	}
+}
+
+// stream of peer is not wanted anymore
+func (st *Stream) abort(err error) {
+	if st.opener {
+		if st.c.grabStream(true, st.session) == st {
+			st.finish(err)
+			st.c.writeCancel(st.session)
+		}
+		return
+	}
+	st.finishRecv(err)
+	st.c.cancelRequest(st.session)
+}
+
+func (st *Stream) finishRecv(err error) {
+	st.recvOnce.Do(func() {
+		st.recvErr = err
+		close(st.recvDone)
+	})
+}
+
+func (st *Stream) close() {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+	})
+}
+
+// stream is over with err, io.EOF means success
+func (st *Stream) finish(err error) {
+	st.finishRecv(err)
+	st.close()
+}
+
+func (st *Stream) addCredit(n int32) {
+	atomic.AddInt32(&st.credit, n)
+	select {
+	case st.creditWake <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) takeCredit() bool {
+	for {
+		credit := atomic.LoadInt32(&st.credit)
+		if credit <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&st.credit, credit, credit-1) {
+			return true
+		}
+	}
+}
+
+func (st *Stream) writeAck(n int) {
+	typ := typeStreamAck
+	if !st.opener {
+		typ = typeStreamReplyAck
+	}
+	var buf [binary.MaxVarintLen64]byte
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(st.session)
+	pack.Type = proto.Int32(typ)
+	pack.Data = buf[:binary.PutUvarint(buf[:], uint64(n))]
+	st.c.writePack(&pack, frameOther)
+}
+
+// error of a stream which is over
+func (st *Stream) closedError() error {
+	select {
+	case <-st.recvDone:
+		if st.recvErr != io.EOF {
+			return st.recvErr
+		}
+	default:
+	}
+	return errStreamClosed
+}
+
+// method of the stream
+func (st *Stream) Descriptor() *Descriptor {
+	return st.dptor
+}
+
+// metadata of the response which ends the stream, valid after Recv returns io.EOF
+func (st *Stream) ReplyMetadata() Metadata {
+	return st.replyMeta
+}
+
+// send a message, blocks until peer has room for it.
+// opener sends ArgType, acceptor sends ReplyType
+func (st *Stream) Send(msg proto.Message) error {
+	typ, msgType := typeStreamMsg, st.dptor.ArgType
+	single := st.dptor.Stream == ServerStream
+	if !st.opener {
+		typ, msgType = typeStreamReply, st.dptor.ReplyType
+		single = st.dptor.Stream == ClientStream
+	}
+	if reflect.TypeOf(msg) != msgType {
+		return fmt.Errorf("stream %s: send unmatch message", st.dptor.NormalName)
+	}
+
+	st.sendLock.Lock()
+	defer st.sendLock.Unlock()
+	if st.sendClosed {
+		return fmt.Errorf("stream %s: send after CloseSend", st.dptor.NormalName)
+	}
+	if single && st.sent > 0 {
+		return fmt.Errorf("stream %s: only one message can be sent", st.dptor.NormalName)
+	}
+
+	for !st.takeCredit() {
+		select {
+		case <-st.creditWake:
+		case <-st.closed:
+			return st.closedError()
+		case <-st.ctx.Done():
+			return contextCallError(st.ctx.Err())
+		}
+	}
+
+	select {
+	case <-st.closed:
+		return st.closedError()
+	default:
+	}
+
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(st.session)
+	pack.Type = proto.Int32(typ)
+	pack.Data, _ = proto.Marshal(msg)
+	if err := st.c.writePack(&pack, frameCall); err != nil {
+		return writeCallError(err)
+	}
+	st.sent++
+	return nil
+}
+
+// opener tells acceptor it has no more messages.
+// stream of acceptor ends when the handler returns, CloseSend only forbids further Send
+func (st *Stream) CloseSend() error {
+	st.sendLock.Lock()
+	defer st.sendLock.Unlock()
+	if st.sendClosed {
+		return nil
+	}
+	st.sendClosed = true
+	if !st.opener {
+		return nil
+	}
+
+	select {
+	case <-st.closed:
+		return nil
+	default:
+	}
+
+	var pack proto_base.Pack
+	pack.Session = proto.Int32(st.session)
+	pack.Type = proto.Int32(typeStreamEnd)
+	return st.c.writePack(&pack, frameOther)
+}
+
+// receive a message, io.EOF is returned when peer finished the stream successfully.
+// opener receives ReplyType, acceptor receives ArgType
+func (st *Stream) Recv(msg proto.Message) error {
+	msgType := st.dptor.ReplyType
+	if !st.opener {
+		msgType = st.dptor.ArgType
+	}
+	if reflect.TypeOf(msg) != msgType {
+		return fmt.Errorf("stream %s: recv unmatch message", st.dptor.NormalName)
+	}
+
+	var data []byte
+	select {
+	case data = <-st.recvq:
+	default:
+		select {
+		case data = <-st.recvq:
+		case <-st.recvDone:
+			// messages arrived before the end
+			select {
+			case data = <-st.recvq:
+			default:
+				return st.recvErr
+			}
+		case <-st.ctx.Done():
+			return contextCallError(st.ctx.Err())
+		}
+	}
+
+	st.consume()
+	return proto.Unmarshal(data, msg)
+}
+
+// grant credits in batch of half window
+func (st *Stream) consume() {
+	st.ackLock.Lock()
+	st.consumed++
+	n := st.consumed
+	if n*2 < cap(st.recvq) {
+		st.ackLock.Unlock()
+		return
+	}
+	st.consumed = 0
+	st.ackLock.Unlock()
+
+	select {
+	case <-st.recvDone:
+		// peer sends no more
+	default:
+		st.writeAck(n)
+	}
+}
@@ -0,0 +1,133 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// max time of TLS handshake if neither handshake timeout nor read timeout is set
+const DefaultHandshakeTimeout = 10 * time.Second
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+/*
+	config of a TLS server
+	if clientCAFile is not empty, clients must present a certificate signed by it (mutual TLS)
+*/
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+/*
+	config of a TLS client
+	server certificate is verified by caFile, or system roots if it's empty.
+	certFile and keyFile are the client certificate for mutual TLS, and may be empty
+*/
+func ClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// listen for TLS connections, pass the listener to Server.Accept
+func ListenTLS(network, address string, config *tls.Config) (net.Listener, error) {
+	return tls.Listen(network, address, config)
+}
+
+func (bridge *Bridge) DialTLS(network, address string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return bridge.NewClient(conn), nil
+}
+
+// max time of TLS handshake, read timeout is used if zero, DefaultHandshakeTimeout if both are zero
+func (c *Context) SetHandshakeTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.activity.handshakeTimeout, int64(d))
+}
+
+// complete TLS handshake before serving, no-op for plain connections.
+// it's always bounded, so a silent peer doesn't hold the connection
+func (c *Context) handshakeTLS() error {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	d := durationOf(&c.activity.handshakeTimeout)
+	if d <= 0 {
+		d = durationOf(&c.activity.readTimeout)
+	}
+	if d <= 0 {
+		d = DefaultHandshakeTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(d))
+	err := conn.Handshake()
+	// serve sets deadline of every read only if read timeout is set
+	conn.SetReadDeadline(time.Time{})
+	return err
+}
+
+// certificates presented by peer, leaf first, nil if connection is not TLS.
+// they are verified only if config verifies peer, e.g. server with a client CA
+func (c *Context) PeerCertificates() []*x509.Certificate {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return conn.ConnectionState().PeerCertificates
+}
+
+// common name of peer certificate, empty if peer has not presented one
+func (c *Context) PeerIdentity() string {
+	certs := c.PeerCertificates()
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
@@ -0,0 +1,273 @@
+package rpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xjdrew/daisy/gen/proto/test"
+)
+
+// self-signed CA which issues certificates of tests, files are in dir
+type testCA struct {
+	dir    string
+	file   string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "daisy test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key, serial: 1}
+	ca.file = ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(t *testing.T, name, typ string, der []byte) string {
+	file := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// issue certificate of name for server and client auth, return cert and key files
+func (ca *testCA) issue(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.write(t, name+".pem", "CERTIFICATE", der), ca.write(t, name+".key", "EC PRIVATE KEY", keyDer)
+}
+
+// TLS server of Test module on loopback
+func listenTLSServer(t *testing.T, config *tls.Config, setup func(*Server)) (*Server, string) {
+	server := NewBridge(testDescriptors).NewServer()
+	impl := &Test{strobe: make(chan string, 16), release: make(chan struct{}), canceled: make(chan error, 1)}
+	if err := server.RegisterModule(impl); err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(server)
+	}
+	l, err := ListenTLS("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	return server, l.Addr().String()
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server")
+	config, err := ServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, addr := listenTLSServer(t, config, func(server *Server) {
+		server.ReadTimeout = 100 * time.Millisecond
+	})
+	defer server.Close()
+
+	// peer connects but never starts handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err == nil {
+		t.Fatal("server should close connection")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatal("handshake is not bounded by read timeout")
+	}
+}
+
+// handshake is bounded even if read timeout is not set
+func TestTLSHandshakeTimeoutWithoutReadTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server")
+	config, err := ServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, addr := listenTLSServer(t, config, func(server *Server) {
+		server.HandshakeTimeout = 100 * time.Millisecond
+	})
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err == nil {
+		t.Fatal("server should close connection")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatal("handshake is not bounded by handshake timeout")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server")
+	clientCert, clientKey := ca.issue(t, "client")
+
+	// mutual TLS, server tells identity of callers
+	config, err := ServerTLSConfig(serverCert, serverKey, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callers := make(chan string, 16)
+	server, addr := listenTLSServer(t, config, func(server *Server) {
+		server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			callers <- c.PeerIdentity()
+			return handler(c, argv, reply)
+		})
+	})
+	defer server.Close()
+
+	bridge := NewBridge(testDescriptors)
+	clientConfig, err := ClientTLSConfig(ca.file, clientCert, clientKey, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := bridge.DialTLS("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	defer client.Close()
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if rsp.GetResp() != "hello" {
+		t.Fatalf("unexpected reply: %s", rsp.GetResp())
+	}
+	if caller := <-callers; caller != "client" {
+		t.Fatalf("unexpected caller identity %q", caller)
+	}
+	if id := client.PeerIdentity(); id != "server" {
+		t.Fatalf("unexpected server identity %q", id)
+	}
+
+	// client without certificate is rejected, during or after handshake
+	anonymous, err := ClientTLSConfig(ca.file, "", "", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client, err := bridge.DialTLS("tcp", addr, anonymous); err == nil {
+		go client.Serve()
+		if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr == nil {
+			t.Fatal("client without certificate should be rejected")
+		}
+		client.Close()
+	}
+
+	// server is not trusted
+	other := newTestCA(t)
+	untrusted, err := ClientTLSConfig(other.file, clientCert, clientKey, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bridge.DialTLS("tcp", addr, untrusted); err == nil {
+		t.Fatal("server certificate should not be trusted")
+	}
+}
+
+func TestTLSWithoutClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server")
+	config, err := ServerTLSConfig(serverCert, serverKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callers := make(chan string, 16)
+	server, addr := listenTLSServer(t, config, func(server *Server) {
+		server.Intercept(func(c *Context, dptor *Descriptor, argv, reply interface{}, handler Handler) *CallError {
+			callers <- c.PeerIdentity()
+			return handler(c, argv, reply)
+		})
+	})
+	defer server.Close()
+
+	clientConfig, err := ClientTLSConfig(ca.file, "", "", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewBridge(testDescriptors).DialTLS("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	defer client.Close()
+
+	var rsp proto_test.Echo_Response
+	if callErr := client.MustCall("test.echo", &proto_test.Echo{Req: proto.String("hello")}, &rsp); callErr != nil {
+		t.Fatal(callErr)
+	}
+	if caller := <-callers; caller != "" {
+		t.Fatalf("anonymous caller has identity %q", caller)
+	}
+	if certs := client.PeerCertificates(); len(certs) == 0 || certs[0].Subject.CommonName != "server" {
+		t.Fatalf("unexpected server certificates %v", certs)
+	}
+}
@@ -0,0 +1,167 @@
+package rpc
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/xjdrew/daisy/gen/proto/base"
+)
+
+/*
+	behavior of Go and Invoke when the write queue of a context is full
+	responses and control frames always wait
+*/
+type QueuePolicy int
+
+const (
+	QueueBlock      QueuePolicy = iota // wait until queue has room
+	QueueFail                          // fail the call or invoke
+	QueueDropInvoke                    // drop invokes, calls wait
+)
+
+const DefaultWriteQueueSize = 256
+
+// max time to flush queued packs when context closes
+const closeFlushTimeout = time.Second
+
+var errContextClosed = errors.New("context closed")
+
+// invoke is dropped by QueueDropInvoke, not reported to caller
+var errInvokeDropped = errors.New("invoke dropped")
+
+// what a frame is, decides how it's queued
+type frameKind int
+
+const (
+	frameCall frameKind = iota
+	frameInvoke
+	frameFanout // invoke of Broadcast and alike, never waits whatever the policy
+	frameOther
+)
+
+// size and policy of write queue, should be called before the context is used
+func (c *Context) SetWriteQueue(size int, policy QueuePolicy) {
+	if size <= 0 {
+		size = DefaultWriteQueueSize
+	}
+	c.outq = make(chan *proto_base.Pack, size)
+	c.queuePolicy = policy
+}
+
+func (c *Context) startWriter() {
+	c.writerOnce.Do(func() {
+		go c.writeLoop()
+	})
+}
+
+// put frame into write queue
+func (c *Context) enqueue(pack *proto_base.Pack, kind frameKind) error {
+	c.startWriter()
+	if isClosed(c.quit) {
+		return errContextClosed
+	}
+
+	wait := kind == frameOther ||
+		(c.queuePolicy == QueueBlock && kind != frameFanout) ||
+		(c.queuePolicy == QueueDropInvoke && kind == frameCall)
+	if wait {
+		select {
+		case c.outq <- pack:
+			return nil
+		case <-c.quit:
+			return errContextClosed
+		}
+	}
+
+	select {
+	case c.outq <- pack:
+		return nil
+	case <-c.quit:
+		return errContextClosed
+	default:
+	}
+
+	if kind == frameInvoke && c.queuePolicy == QueueDropInvoke {
+		log.Printf("write queue full, drop invoke:%d", pack.GetType())
+		return errInvokeDropped
+	}
+	return NewCallError(ErrCodeQueueFull, "write queue is full")
+}
+
+// queue frame if there is room, it's dropped otherwise
+func (c *Context) tryEnqueue(pack *proto_base.Pack) bool {
+	c.startWriter()
+	select {
+	case c.outq <- pack:
+		return true
+	default:
+		return false
+	}
+}
+
+// the only goroutine writes to connection, queued packs are flushed in batch
+func (c *Context) writeLoop() {
+	defer close(c.writerDone)
+	for {
+		select {
+		case pack := <-c.outq:
+			if !c.writeBatch(pack) {
+				return
+			}
+		case <-c.quit:
+			// flush what is left
+			for {
+				select {
+				case pack := <-c.outq:
+					if !c.writeBatch(pack) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Context) writeBatch(pack *proto_base.Pack) bool {
+	c.setWriteDeadline()
+	err := c.bufferPack(pack)
+	c.touch(pack, true)
+	for err == nil {
+		select {
+		case pack = <-c.outq:
+			err = c.bufferPack(pack)
+			c.touch(pack, true)
+			continue
+		default:
+		}
+		break
+	}
+	if err == nil {
+		err = c.codec.Flush()
+	}
+	if err != nil {
+		c.setError(err)
+		go c.Close()
+		return false
+	}
+	return true
+}
+
+// preamble is queued as a pseudo pack, so it's ordered with other packs
+func (c *Context) bufferPack(pack *proto_base.Pack) error {
+	if pack.GetType() == typeNegotiate {
+		return c.codec.Negotiate(Framing(pack.Data[0]))
+	}
+	return c.codec.BufferPack(pack)
+}
+
+// stop writer after queued packs are flushed
+func (c *Context) stopWriter() {
+	c.startWriter()
+	close(c.quit)
+	c.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+	<-c.writerDone
+}